@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// valueOptionRe matches the options in the usage that take a value, like
+// "--onto=<ref>" or "-C <path>".
+var valueOptionRe = regexp.MustCompile(`(-{1,2}[\w-]+)[= ]<`)
+
+// commandIndex returns the index in argv of the command word: the first
+// argument that's neither an option nor the value of one. It returns -1 if
+// there isn't one.
+func commandIndex(usage string, argv []string) int {
+	takesValue := map[string]bool{}
+	for _, m := range valueOptionRe.FindAllStringSubmatch(usage, -1) {
+		takesValue[m[1]] = true
+	}
+	for i := 0; i < len(argv); i++ {
+		if !strings.HasPrefix(argv[i], "-") {
+			return i
+		}
+		if takesValue[argv[i]] {
+			i++
+		}
+	}
+	return -1
+}
+
+// isCommand reports whether word is one of the commands in usage's Usage
+// section.
+func isCommand(usage string, word string) bool {
+	for _, line := range strings.Split(usage, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "git_ext" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if strings.Trim(field, "()[]|.") == word {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// optionValue returns the value given to the option name in options, in any
+// of the forms docopt accepts, or "" if it isn't there.
+func optionValue(options []string, name string) string {
+	for i, option := range options {
+		switch {
+		case option == name && i+1 < len(options):
+			return options[i+1]
+		case strings.HasPrefix(option, name+"="):
+			return option[len(name)+1:]
+		case len(name) == 2 && strings.HasPrefix(option, name) && len(option) > 2:
+			return option[2:]
+		}
+	}
+	return ""
+}
+
+// aliasSteps splits an alias's definition into the command lines it runs.
+func aliasSteps(definition string) [][]string {
+	steps := [][]string{}
+	for _, step := range strings.Split(definition, "&&") {
+		if fields := strings.Fields(step); len(fields) > 0 {
+			steps = append(steps, fields)
+		}
+	}
+	return steps
+}
+
+// aliasCycle returns the chain of aliases from name back to one already in
+// chain, if running name would run an alias that's already running, or nil.
+func aliasCycle(usage string, aliases map[string]string, name string, chain []string) []string {
+	chain = append(chain, name)
+	for _, running := range chain[:len(chain)-1] {
+		if running == name {
+			return chain
+		}
+	}
+	for _, step := range aliasSteps(aliases[name]) {
+		i := commandIndex(usage, step)
+		if i < 0 || step[0] == "git" {
+			continue
+		}
+		if _, ok := aliases[step[i]]; ok && !isCommand(usage, step[i]) {
+			if cycle := aliasCycle(usage, aliases, step[i], chain); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// runAlias runs argv's command as an alias from the config file, if it is
+// one, and reports whether it was. An alias is a sequence of git_ext
+// commands separated by "&&", run in order until one fails; a step starting
+// with "git" runs git itself. Options given before the alias are passed to
+// every step. Aliases can use other aliases, but not in a cycle, and can't
+// replace built-in commands.
+func runAlias(w io.Writer, errW io.Writer, usage string, argv []string) (bool, error) {
+	i := commandIndex(usage, argv)
+	if i < 0 || isCommand(usage, argv[i]) {
+		return false, nil
+	}
+	name, options := argv[i], argv[:i]
+	if dir := optionValue(options, "-C"); dir != "" {
+		workDir = dir
+	}
+	cfg, err := loadConfig(cliRunner{verbosityQuiet, w})
+	if err != nil {
+		return true, err
+	}
+	definition, ok := cfg.Aliases[name]
+	if !ok {
+		// Let docopt report the unknown command.
+		return false, nil
+	}
+	if len(argv) > i+1 {
+		return true, newUsageError("alias %s doesn't take arguments, got %s", name, strings.Join(argv[i+1:], " "))
+	}
+	if cycle := aliasCycle(usage, cfg.Aliases, name, nil); cycle != nil {
+		return true, fmt.Errorf("alias %s never finishes: %s", name, strings.Join(cycle, " -> "))
+	}
+	steps := aliasSteps(definition)
+	if len(steps) == 0 {
+		return true, fmt.Errorf("alias %s is empty", name)
+	}
+	color := optionValue(options, "--color")
+	if color == "" {
+		color = cfg.Color
+	}
+	if err := setColor(w, color); err != nil {
+		return true, err
+	}
+	dryRun = hasArg(options, "--dry-run")
+	verbose := verbosityNormal
+	if hasArg(options, "-q", "--quiet") {
+		verbose = verbosityQuiet
+	} else if hasArg(options, "--verbose") || cfg.Verbose {
+		verbose = verbosityVerbose
+	}
+	retries := optionValue(options, "--retries")
+	if retries == "" {
+		retries = "0"
+	}
+	finish, err := setUpRunner(w, errW, retries, resolvePath(optionValue(options, "--log")), hasArg(options, "--timings"))
+	if err != nil {
+		return true, err
+	}
+	defer finish()
+	inAlias = true
+	defer func() { inAlias = false }()
+	for n, step := range steps {
+		if verbose != verbosityQuiet && len(steps) > 1 {
+			fmt.Fprintf(w, "[%d/%d] %s\n", n+1, len(steps), strings.Join(step, " "))
+		}
+		if step[0] == "git" {
+			output, err := rungit(w, step[1:], verbose)
+			if err != nil {
+				return true, err
+			}
+			if output != "" && (verbose != verbosityQuiet || isReadOnly(step[1:])) {
+				fmt.Fprintln(w, output)
+			}
+			continue
+		}
+		if err := runArgs(w, errW, append(append([]string{}, options...), step...)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
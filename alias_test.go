@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cjfuller/git_ext/testutil"
+)
+
+func TestAliasDryRun(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a")
+	repo.WriteFile(configFileName, "aliases:\n  mk: git branch made && git rev-parse --abbrev-ref HEAD\n")
+
+	out := repo.MustGitExt("--dry-run", "mk")
+	if repo.Git("branch", "--list", "made") != "" {
+		t.Error("--dry-run ran a git step that changes the repo")
+	}
+	if !strings.Contains(out, "feat-a\n") {
+		t.Errorf("the read-only step's output isn't shown:\n%s", out)
+	}
+	repo.MustGitExt("mk")
+	if repo.Git("branch", "--list", "made") == "" {
+		t.Error("the alias didn't create the branch")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type completionCommand struct {
+	Name        string
+	Description string
+}
+
+// completionCommands lists the commands offered by shell completion. Keep it
+// in sync with the usage string.
+var completionCommands = []completionCommand{
+	{"lh", "print the most recent commit hash"},
+	{"lasthash", "print the most recent commit hash"},
+	{"shup", "print the upstream branch"},
+	{"show_up", "print the upstream branch"},
+	{"fu", "reset to the latest commit on top of the upstream"},
+	{"fix_up", "reset to the latest commit on top of the upstream"},
+	{"fix_upstream", "reset to the latest commit on top of the upstream"},
+	{"up", "set upstream, then run fix_up"},
+	{"rup", "recursively fix up from a terminal branch"},
+	{"rec_fix_up", "recursively fix up from a terminal branch"},
+	{"cbr", "move the last commit to a new branch"},
+	{"commit_br", "move the last commit to a new branch"},
+	{"tree", "draw the tree of branches"},
+	{"show_tree", "draw the tree of branches"},
+	{"amend", "amend the last commit and fix up the branches on top"},
+	{"fixup-commit", "commit what's staged as a fixup of an earlier commit"},
+	{"fixup_commit", "commit what's staged as a fixup of an earlier commit"},
+	{"po", "force push to the remote"},
+	{"push_origin", "force push to the remote"},
+	{"push-stack", "force push every pushed branch in this stack"},
+	{"push_stack", "force push every pushed branch in this stack"},
+	{"sync", "fix up every branch stacked on the remote"},
+	{"rebase-stack", "move this stack onto a new base"},
+	{"rebase_stack", "move this stack onto a new base"},
+	{"undo", "undo the last fix_up or commit_br on this branch"},
+	{"log-stack", "print the commits each branch in this stack adds"},
+	{"log_stack", "print the commits each branch in this stack adds"},
+	{"current", "print where HEAD is on one line"},
+	{"cur", "print where HEAD is on one line"},
+	{"status", "print a table of every branch"},
+	{"prune", "delete branches whose upstream is gone"},
+	{"clean-merged", "delete branches merged into a base"},
+	{"clean_merged", "delete branches merged into a base"},
+	{"rename", "rename a branch and re-point its downstreams"},
+	{"move", "re-parent a branch onto a new upstream"},
+	{"list", "print branch metadata for scripts"},
+	{"stashes", "list stashes by the branch they were made on"},
+	{"leaves", "print the branches at the tips of stacks"},
+	{"branches", "print the branches at the tips of stacks"},
+	{"root-of", "print the bottom of a branch's stack of upstreams"},
+	{"workspace", "save and return to named stacks"},
+	{"export", "write this stack out as patches"},
+	{"import", "recreate a stack from exported patches"},
+	{"apply-stack", "set upstreams from a stack file"},
+	{"config", "get or set git_ext's settings"},
+	{"doctor", "check the repository for common problems"},
+	{"completion", "print a shell completion script"},
+}
+
+// branchArgCommands take a branch name as their argument, so completion
+// offers local branches for them.
+var branchArgCommands = []string{"up", "rup", "rec_fix_up", "cbr", "commit_br", "rename", "move", "root-of"}
+
+const branchListCommand = "git branch --format='%(refname:short)' 2>/dev/null"
+
+func commandNames() []string {
+	names := []string{}
+	for _, cmd := range completionCommands {
+		names = append(names, cmd.Name)
+	}
+	return names
+}
+
+const bashCompletion = `_git_ext() {
+	local cur cmd i
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		if [[ "${COMP_WORDS[i]}" != -* ]]; then
+			cmd="${COMP_WORDS[i]}"
+			break
+		fi
+	done
+	if [[ -z "$cmd" ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case "$cmd" in
+		%s)
+			COMPREPLY=($(compgen -W "$(%s)" -- "$cur"))
+			;;
+		completion)
+			COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+			;;
+	esac
+}
+complete -F _git_ext git_ext
+`
+
+const zshCompletion = `#compdef git_ext
+_git_ext() {
+	local -a commands branches
+	commands=(
+%s
+	)
+	if (( CURRENT == 2 )); then
+		_describe 'command' commands
+		return
+	fi
+	case "${words[2]}" in
+		%s)
+			branches=(${(f)"$(%s)"})
+			_describe 'branch' branches
+			;;
+		completion)
+			_values 'shell' bash zsh fish
+			;;
+	esac
+}
+compdef _git_ext git_ext
+`
+
+func printCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		fmt.Fprintf(w, bashCompletion,
+			strings.Join(commandNames(), " "),
+			strings.Join(branchArgCommands, "|"),
+			branchListCommand)
+	case "zsh":
+		described := []string{}
+		for _, cmd := range completionCommands {
+			described = append(described, fmt.Sprintf("\t\t'%s:%s'", cmd.Name, cmd.Description))
+		}
+		fmt.Fprintf(w, zshCompletion,
+			strings.Join(described, "\n"),
+			strings.Join(branchArgCommands, "|"),
+			branchListCommand)
+	case "fish":
+		fmt.Fprintln(w, "complete -c git_ext -f")
+		for _, cmd := range completionCommands {
+			fmt.Fprintf(w, "complete -c git_ext -n '__fish_use_subcommand' -a %s -d '%s'\n",
+				cmd.Name, cmd.Description)
+		}
+		fmt.Fprintf(w, "complete -c git_ext -n '__fish_seen_subcommand_from %s' -a \"(%s)\"\n",
+			strings.Join(branchArgCommands, " "), branchListCommand)
+		fmt.Fprintln(w, "complete -c git_ext -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'")
+	default:
+		return newUsageError("unsupported shell %q: expected bash, zsh, or fish", shell)
+	}
+	return nil
+}
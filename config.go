@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const configFileName = ".git_ext.yml"
+
+// config holds defaults read from .git_ext.yml and the environment. Command
+// line flags take precedence over anything set here.
+type config struct {
+	Verbose         bool   `yaml:"verbose"`
+	DefaultUpstream string `yaml:"default_upstream"`
+	Color           string `yaml:"color"`
+	Indent          *int   `yaml:"indent"`
+	Remote          string `yaml:"remote"`
+	// Aliases maps names to the "&&"-separated commands runAlias runs.
+	Aliases map[string]string `yaml:"aliases"`
+}
+
+// configKeys are the settings `git_ext config` can get and set, each with a
+// function that checks a value and converts it to the type it's stored as.
+var configKeys = map[string]func(value string) (interface{}, error){
+	"verbose": func(value string) (interface{}, error) {
+		verbose, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false, got %q", value)
+		}
+		return verbose, nil
+	},
+	"default_upstream": nonEmptyConfig,
+	"color": func(value string) (interface{}, error) {
+		if value != "always" && value != "never" && value != "auto" {
+			return nil, fmt.Errorf("must be always, never, or auto, got %q", value)
+		}
+		return value, nil
+	},
+	"indent": func(value string) (interface{}, error) {
+		indent, err := strconv.Atoi(value)
+		if err != nil || indent < 0 {
+			return nil, fmt.Errorf("must be a non-negative integer, got %q", value)
+		}
+		return indent, nil
+	},
+	"remote": nonEmptyConfig,
+}
+
+func nonEmptyConfig(value string) (interface{}, error) {
+	if value == "" {
+		return nil, fmt.Errorf("can't be empty")
+	}
+	return value, nil
+}
+
+// findConfigFile looks for .git_ext.yml in dir and each of its parents,
+// returning "" if there isn't one.
+func findConfigFile(dir string) string {
+	for {
+		path := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadConfig reads the config file, searching upward from the repository root
+// (or the working directory, outside a repository), then applies any
+// GIT_EXT_* environment overrides.
+func loadConfig(git gitext.Runner) (config, error) {
+	cfg := config{}
+	dir, err := repoTopLevel(git)
+	if err != nil {
+		if dir, err = os.Getwd(); err != nil {
+			return cfg, err
+		}
+	}
+	if path := findConfigFile(dir); path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err := yaml.UnmarshalStrict(contents, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %v", path, err)
+		}
+		if cfg.Color != "" {
+			if _, err := configKeys["color"](cfg.Color); err != nil {
+				return cfg, fmt.Errorf("%s: color %v", path, err)
+			}
+		}
+		if cfg.Indent != nil && *cfg.Indent < 0 {
+			return cfg, fmt.Errorf("%s: indent must be a non-negative integer, got %d", path, *cfg.Indent)
+		}
+	}
+	if verbose := os.Getenv("GIT_EXT_VERBOSE"); verbose != "" {
+		if cfg.Verbose, err = strconv.ParseBool(verbose); err != nil {
+			return cfg, fmt.Errorf("GIT_EXT_VERBOSE: %v", err)
+		}
+	}
+	if upstream := os.Getenv("GIT_EXT_DEFAULT_UPSTREAM"); upstream != "" {
+		cfg.DefaultUpstream = upstream
+	}
+	return cfg, nil
+}
+
+// configPath is the config file `git_ext config` reads and writes: the one
+// loadConfig would find, or a new one at the top of the repository.
+func configPath(git gitext.Runner) (string, error) {
+	dir, err := repoTopLevel(git)
+	if err != nil {
+		return "", err
+	}
+	if path := findConfigFile(dir); path != "" {
+		return path, nil
+	}
+	return filepath.Join(dir, configFileName), nil
+}
+
+// readConfigFile reads path as an ordered list of settings, so that it can be
+// written back in the same order. A missing file has no settings.
+func readConfigFile(path string) (yaml.MapSlice, error) {
+	settings := yaml.MapSlice{}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return settings, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(contents, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return settings, nil
+}
+
+func checkConfigKey(key string) error {
+	if _, ok := configKeys[key]; !ok {
+		return newUsageError("unknown config key %q; known keys are %s", key, strings.Join(configKeyNames(), ", "))
+	}
+	return nil
+}
+
+func configKeyNames() []string {
+	names := []string{}
+	for name := range configKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getConfig prints key's value from the config file. It's an error for key
+// not to be set there.
+func getConfig(w io.Writer, git gitext.Runner, key string) error {
+	if err := checkConfigKey(key); err != nil {
+		return err
+	}
+	path, err := configPath(git)
+	if err != nil {
+		return err
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, item := range settings {
+		if item.Key == key {
+			fmt.Fprintln(w, item.Value)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't set in %s", key, path)
+}
+
+// setConfig checks value and writes it to the config file as key, creating
+// the file if there isn't one. Comments in the file aren't kept.
+func setConfig(git gitext.Runner, key string, value string) error {
+	if err := checkConfigKey(key); err != nil {
+		return err
+	}
+	parsed, err := configKeys[key](value)
+	if err != nil {
+		return newUsageError("%s %v", key, err)
+	}
+	path, err := configPath(git)
+	if err != nil {
+		return err
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i, item := range settings {
+		if item.Key == key {
+			settings[i].Value = parsed
+			found = true
+		}
+	}
+	if !found {
+		settings = append(settings, yaml.MapItem{Key: key, Value: parsed})
+	}
+	contents, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cjfuller/git_ext/testutil"
+)
+
+// setenv sets key to value, or unsets it if value is empty, returning a func
+// that puts it back.
+func setenv(key string, value string) func() {
+	old, had := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	return func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestDefaultUpstreamPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    string
+		args   []string
+		// want is the upstream up picks, or "" if it should fail with a
+		// usage error for lack of one.
+		want string
+	}{
+		{name: "built-in default", want: ""},
+		{name: "config file", config: "cfg-up", want: "cfg-up"},
+		{name: "env beats config file", config: "cfg-up", env: "env-up", want: "env-up"},
+		{name: "env alone", env: "env-up", want: "env-up"},
+		{name: "flag beats env", config: "cfg-up", env: "env-up", args: []string{"flag-up"}, want: "flag-up"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := testutil.NewRepo(t)
+			defer repo.Close()
+			for _, name := range []string{"cfg-up", "env-up", "flag-up"} {
+				repo.Git("branch", name)
+			}
+			repo.Stack("main", "feat")
+			if test.config != "" {
+				repo.WriteFile(configFileName, "default_upstream: "+test.config+"\n")
+			}
+			defer setenv("GIT_EXT_DEFAULT_UPSTREAM", test.env)()
+			result := repo.GitExt(append([]string{"--dry-run", "up"}, test.args...)...)
+			if test.want == "" {
+				if result.ExitCode != exitUsage {
+					t.Errorf("up with no upstream anywhere exited %d, want %d", result.ExitCode, exitUsage)
+				}
+				return
+			}
+			if result.ExitCode != 0 {
+				t.Fatalf("up exited %d:\n%s", result.ExitCode, result.Stderr)
+			}
+			if !strings.Contains(result.Stdout, "--set-upstream-to "+test.want+"\n") {
+				t.Errorf("up didn't pick %s:\n%s", test.want, result.Stdout)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+type checkResult int
+
+const (
+	checkPass checkResult = iota
+	checkWarn
+	checkFail
+)
+
+func (r checkResult) String() string {
+	switch r {
+	case checkPass:
+		return colorize("PASS", "green")
+	case checkWarn:
+		return colorize("WARN", "yellow")
+	default:
+		return colorize("FAIL", "red")
+	}
+}
+
+// doctorCheck is one line of the doctor report. Hint says how to fix a
+// warning or failure.
+type doctorCheck struct {
+	Name   string
+	Result checkResult
+	Hint   string
+}
+
+// runDoctorChecks checks the things git_ext's commands assume about the
+// repository. Checks that depend on an earlier one that failed are skipped.
+func runDoctorChecks(git gitext.Runner) []doctorCheck {
+	checks := []doctorCheck{}
+	add := func(name string, result checkResult, hint string) {
+		checks = append(checks, doctorCheck{Name: name, Result: result, Hint: hint})
+	}
+
+	if _, err := repoTopLevel(git); err != nil {
+		add("in a git repository", checkFail, "cd into a git repository")
+		return checks
+	}
+	add("in a git repository", checkPass, "")
+
+	if clean, err := gitext.IsClean(git); err != nil {
+		add("working tree is clean", checkFail, err.Error())
+	} else if !clean {
+		add("working tree is clean", checkWarn, "commit or stash your changes, or pass --autostash")
+	} else {
+		add("working tree is clean", checkPass, "")
+	}
+
+	if present, err := gitext.HasSubmodules(git); err != nil {
+		add("submodules are initialized", checkFail, err.Error())
+	} else if present {
+		status, err := git.Run([]string{"submodule", "status"})
+		if err != nil {
+			add("submodules are initialized", checkFail, "check .gitmodules; or pass --no-submodules or --submodules-best-effort")
+		} else if strings.Contains("\n"+status, "\n-") {
+			add("submodules are initialized", checkWarn, "run `git submodule update --init --recursive`")
+		} else {
+			add("submodules are initialized", checkPass, "")
+		}
+	}
+
+	branch, detached, err := gitext.CurrentBranch(git)
+	if err != nil {
+		add("HEAD is on a branch", checkFail, err.Error())
+		return checks
+	}
+	if detached {
+		add("HEAD is on a branch", checkFail, "check out a branch with `git checkout <branch>`")
+		return checks
+	}
+	add("HEAD is on a branch", checkPass, "")
+
+	upstream, err := gitext.UpstreamOf(git, branch)
+	if err != nil {
+		add("branch has an upstream", checkWarn, "set one with `git_ext up <branch>`")
+		return checks
+	}
+	add("branch has an upstream", checkPass, "")
+
+	if exists, err := gitext.RefExists(git, upstream); err != nil || !exists {
+		add("upstream "+upstream+" resolves", checkFail, "fetch it, or pick another with `git_ext up <branch>`")
+	} else {
+		add("upstream "+upstream+" resolves", checkPass, "")
+	}
+	return checks
+}
+
+// printDoctorReport writes one line per check, with hints for anything that
+// didn't pass, and returns the number of failures.
+func printDoctorReport(w io.Writer, checks []doctorCheck) (int, error) {
+	failures := 0
+	for _, check := range checks {
+		if check.Result == checkFail {
+			failures++
+		}
+		line := check.Result.String() + "  " + check.Name
+		if check.Hint != "" {
+			line += " (" + check.Hint + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return failures, err
+		}
+	}
+	return failures, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// printBranchTreeDot writes the tree as a Graphviz digraph, with an edge from
+// each upstream to its downstream branches.
+func printBranchTreeDot(w io.Writer, rootBranches []*gitext.Branch, branchMap map[string]*gitext.Branch) {
+	fmt.Fprintln(w, "digraph branches {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box, style=rounded];")
+	upstreams := map[string]bool{}
+	roots := map[*gitext.Branch]bool{}
+	for _, root := range rootBranches {
+		roots[root] = true
+		if !upstreamShown(root, branchMap) || upstreamMissing(root, branchMap) || upstreams[root.Desc.Upstream] {
+			continue
+		}
+		upstreams[root.Desc.Upstream] = true
+		fmt.Fprintf(w, "  %s [style=\"rounded,filled\", fillcolor=lightblue];\n", strconv.Quote(root.Desc.Upstream))
+	}
+	for _, br := range gitext.StackOrder(rootBranches) {
+		attrs := "label=" + strconv.Quote(br.Desc.Name+"\n"+shortSha(br.Desc.Sha))
+		if br.Desc.Current {
+			attrs += ", style=\"rounded,filled\", fillcolor=palegreen"
+		}
+		if !br.HasUpstream && !br.Desc.Remote && upstreamMissing(br, branchMap) {
+			attrs += ", style=\"rounded,dashed\", color=red"
+		}
+		fmt.Fprintf(w, "  %s [%s];\n", strconv.Quote(br.Desc.Name), attrs)
+		if (br.HasUpstream && !roots[br]) || upstreams[br.Desc.Upstream] {
+			fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote(br.Desc.Upstream), strconv.Quote(br.Desc.Name))
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// printBranchTreeMermaid writes the tree as a Mermaid flowchart, with an edge
+// from each upstream to its downstream branches. Nodes get generated ids since
+// branch names can contain characters Mermaid doesn't allow in ids.
+func printBranchTreeMermaid(w io.Writer, rootBranches []*gitext.Branch, branchMap map[string]*gitext.Branch) {
+	fmt.Fprintln(w, "graph TD")
+	ids := map[string]string{}
+	nodeID := func(name string) string {
+		if id, ok := ids[name]; ok {
+			return id
+		}
+		ids[name] = "n" + strconv.Itoa(len(ids))
+		return ids[name]
+	}
+	upstreams := map[string]bool{}
+	roots := map[*gitext.Branch]bool{}
+	for _, root := range rootBranches {
+		roots[root] = true
+		if !upstreamShown(root, branchMap) || upstreamMissing(root, branchMap) || upstreams[root.Desc.Upstream] {
+			continue
+		}
+		upstreams[root.Desc.Upstream] = true
+		fmt.Fprintf(w, "  %s([%s]):::remote\n", nodeID(root.Desc.Upstream), mermaidLabel(root.Desc.Upstream))
+	}
+	for _, br := range gitext.StackOrder(rootBranches) {
+		class := ""
+		if br.Desc.Current {
+			class = ":::current"
+		} else if !br.HasUpstream && !br.Desc.Remote && upstreamMissing(br, branchMap) {
+			class = ":::missing"
+		}
+		fmt.Fprintf(w, "  %s[%s]%s\n", nodeID(br.Desc.Name), mermaidLabel(br.Desc.Name+"<br/>"+shortSha(br.Desc.Sha)), class)
+		if (br.HasUpstream && !roots[br]) || upstreams[br.Desc.Upstream] {
+			fmt.Fprintf(w, "  %s --> %s\n", nodeID(br.Desc.Upstream), nodeID(br.Desc.Name))
+		}
+	}
+	fmt.Fprintln(w, "  classDef remote fill:#add8e6")
+	fmt.Fprintln(w, "  classDef current fill:#98fb98")
+	fmt.Fprintln(w, "  classDef missing stroke:#f00,stroke-dasharray:4 4")
+}
+
+// mermaidLabel quotes s for use as a Mermaid node label.
+func mermaidLabel(s string) string {
+	return `"` + strings.Replace(s, `"`, "#quot;", -1) + `"`
+}
+
+// printBranchTreePorcelain writes one tab-separated line per branch, in tree
+// order: depth (0 for roots), name, full sha, upstream, ahead, behind, and 1
+// if the branch is checked out, else 0. Scripts depend on these fields, so
+// only ever add new ones at the end.
+func printBranchTreePorcelain(w io.Writer, branches []*gitext.Branch, depth int) error {
+	for _, br := range branches {
+		current := 0
+		if br.Desc.Current {
+			current = 1
+		}
+		if _, err := fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\n", depth, br.Desc.Name, br.Desc.Sha, br.Desc.Upstream, br.Desc.Ahead, br.Desc.Behind, current); err != nil {
+			return err
+		}
+		if err := printBranchTreePorcelain(w, br.Downstream, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateFuncs are the functions available to --template, beyond text/template's
+// builtins.
+var templateFuncs = template.FuncMap{
+	"short": shortSha,
+}
+
+// parseTreeTemplate parses the --template text that each branch of the tree
+// is rendered with.
+func parseTreeTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("tree").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, newUsageError("--template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// printBranchTreeTemplate renders each branch's gitext.BranchDescriptor with
+// tmpl, one line per branch in tree order, indented by its depth.
+func printBranchTreeTemplate(w io.Writer, branches []*gitext.Branch, tmpl *template.Template, depth int) error {
+	for _, br := range branches {
+		if _, err := io.WriteString(w, strings.Repeat(" ", indentAmount*depth)); err != nil {
+			return err
+		}
+		if err := tmpl.Execute(w, br.Desc); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+		if err := printBranchTreeTemplate(w, br.Downstream, tmpl, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
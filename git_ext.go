@@ -1,255 +1,1215 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
-	"text/tabwriter"
+	"time"
 
+	"github.com/cjfuller/git_ext/gitext"
 	docopt "github.com/docopt/docopt-go"
+	"github.com/mattn/go-isatty"
 	"github.com/mgutz/ansi"
 )
 
-func rungit(cmdargs []string, verbose bool) string {
-	cmd := "git"
-	if verbose {
-		fmt.Println(ansi.Color("cmd", "white+b:green") + " " +
-			cmd + " " + strings.Join(cmdargs, " "))
-	}
-	cmdObj := exec.Command(cmd, cmdargs...)
-	cmdOutput, err := cmdObj.Output()
-	if exiterr, ok := err.(*exec.ExitError); ok {
-		fmt.Println(string(exiterr.Stderr))
-		os.Exit(1)
-	} else if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// colorEnabled controls whether colorize adds ANSI color codes. It's set by
+// --color; by default it's off when NO_COLOR is set or stdout isn't a
+// terminal.
+var colorEnabled = true
+
+// colorize wraps s in the ANSI codes for spec (see ansi.Color), or returns it
+// unchanged when color is disabled.
+func colorize(s string, spec string) string {
+	if !colorEnabled {
+		return s
 	}
-	if verbose {
-		fmt.Println(string(cmdOutput))
+	return ansi.Color(s, spec)
+}
+
+// setColor sets colorEnabled for --color=color, writing to w.
+func setColor(w io.Writer, color string) error {
+	switch color {
+	case "always":
+		colorEnabled = true
+	case "never":
+		colorEnabled = false
+	case "auto", "":
+		f, ok := w.(*os.File)
+		colorEnabled = os.Getenv("NO_COLOR") == "" && ok && isatty.IsTerminal(f.Fd())
+	default:
+		return newUsageError("--color must be always, never, or auto, got %q", color)
 	}
-	return strings.TrimSpace(string(cmdOutput))
+	return nil
 }
 
-func lasthash(verbose bool) string {
-	return rungit([]string{"log", "-n", "1", "--pretty=format:%H"}, verbose)
+// gitCmd is the git executable rungit invokes. It's resolved once at startup
+// by resolveGit.
+var gitCmd = "git"
+
+// resolveGit picks the git executable from GIT_EXT_GIT (falling back to
+// "git" on the PATH) and checks that it actually runs.
+func resolveGit() error {
+	name := os.Getenv("GIT_EXT_GIT")
+	if name == "" {
+		name = "git"
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("unable to find git executable %q: %v", name, err)
+	}
+	if strings.ContainsRune(name, filepath.Separator) {
+		if path, err = filepath.Abs(path); err != nil {
+			return err
+		}
+		name = path
+	}
+	if err := exec.Command(path, "--version").Run(); err != nil {
+		return fmt.Errorf("unable to run git executable %q: %v", path, err)
+	}
+	gitCmd = name
+	return nil
 }
 
-func ensureClean() {
-	status := rungit([]string{"status"}, false)
-	if !(strings.Contains(status, "nothing to commit, working directory clean") ||
-		strings.Contains(status, "nothing to commit, working tree clean")) {
-		fmt.Println(ansi.Color(status, "white:red"))
-		os.Exit(1)
+// gitTimeout bounds how long any single git command may run, as set by
+// GIT_EXT_TIMEOUT. Zero means no limit.
+var gitTimeout time.Duration
+
+func resolveTimeout() error {
+	timeout := os.Getenv("GIT_EXT_TIMEOUT")
+	if timeout == "" {
+		return nil
+	}
+	var err error
+	if gitTimeout, err = time.ParseDuration(timeout); err != nil {
+		return fmt.Errorf("GIT_EXT_TIMEOUT: %v", err)
 	}
+	return nil
 }
 
-func handleSubmodules(verbose bool) {
-	rungit([]string{"submodule", "init"}, verbose)
-	rungit([]string{"submodule", "update", "--recursive"}, verbose)
+// dryRun, when set, makes rungit print mutating commands rather than running
+// them. Read-only commands still run, since later steps depend on their output.
+var dryRun = false
+
+var readOnlyCommands = map[string]bool{
+	"diff":         true,
+	"diff-tree":    true,
+	"for-each-ref": true,
+	"log":          true,
+	"merge-base":   true,
+	"rev-list":     true,
+	"rev-parse":    true,
+	"status":       true,
 }
 
-func getUpstream(verbose bool) string {
-	return rungit([]string{"rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}"}, verbose)
+func isReadOnly(cmdargs []string) bool {
+	if len(cmdargs) == 0 {
+		return true
+	}
+	switch cmdargs[0] {
+	case "remote":
+		return len(cmdargs) == 1
+	case "branch":
+		return hasArg(cmdargs[1:], "-vv", "--list", "--merged")
+	case "config":
+		return hasArg(cmdargs[1:], "--get", "--get-all", "--get-regexp")
+	case "submodule":
+		return hasArg(cmdargs[1:], "status")
+	}
+	return readOnlyCommands[cmdargs[0]]
 }
 
-func getCurrBranch(verbose bool) string {
-	return rungit([]string{"rev-parse", "--abbrev-ref", "HEAD"}, verbose)
+// hasArg reports whether any of args is one of names.
+func hasArg(args []string, names ...string) bool {
+	for _, arg := range args {
+		for _, name := range names {
+			if arg == name {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func fixUpstream(upstream string, verbose bool) {
-	commit := lasthash(verbose)
-	rungit([]string{"branch", "--set-upstream-to", upstream}, true)
-	ensureClean()
-	rungit([]string{"reset", "--hard", upstream, "--"}, true)
-	handleSubmodules(true)
-	rungit([]string{"cherry-pick", commit}, true)
-	handleSubmodules(true)
+// verbosity is how much output git_ext prints besides a command's result.
+type verbosity int
+
+const (
+	verbosityQuiet verbosity = iota
+	verbosityNormal
+	verbosityVerbose
+)
+
+// steps is the verbosity for each branch's part of a multi-branch command,
+// which prints progress lines instead of echoing every git command unless
+// --verbose was given.
+func (v verbosity) steps() verbosity {
+	if v == verbosityVerbose {
+		return v
+	}
+	return verbosityQuiet
 }
 
-func checkout(branch string, verbose bool) {
-	rungit([]string{"checkout", branch}, verbose)
-	handleSubmodules(verbose)
+// printRecFixUpPlan describes the upstreams rup walked to reach terminal and
+// the order it'll fix up the branches on the way in.
+func printRecFixUpPlan(w io.Writer, chain []string, terminal string) {
+	down := append([]string{terminal}, chain...)
+	up := make([]string, len(down))
+	for i, branch := range down {
+		up[len(down)-1-i] = branch
+	}
+	fmt.Fprintf(w, "walking up: %s; applying down: %s\n", strings.Join(up, " -> "), strings.Join(down, " -> "))
 }
 
-func recFixUp(terminal string, verbose bool, branchCache []string) {
-	currBranch := getCurrBranch(verbose)
-	if currBranch == terminal {
-		for _, branch := range branchCache {
-			checkout(branch, true)
-			fixUpstream(getUpstream(false), verbose)
-		}
-		return
+// printProgress announces the step'th of total branches a multi-branch
+// command is fixing up.
+func printProgress(w io.Writer, step int, total int, branch string, verbose verbosity) {
+	setStep(fmt.Sprintf("fixing %s (%d/%d)", branch, step, total))
+	if verbose != verbosityQuiet {
+		fmt.Fprintf(w, "[%d/%d] fixing %s ...\n", step, total, branch)
 	}
-	currUpstream := getUpstream(verbose)
-	checkout(currUpstream, false)
-	recFixUp(terminal, verbose, append([]string{currBranch}, branchCache...))
 }
 
-func commitBranch(branchName string, verbose bool) {
-	rungit([]string{"branch", branchName}, true)
-	ensureClean()
-	rungit([]string{"reset", "--hard", "HEAD~1"}, true)
-	rungit([]string{"checkout", branchName}, true)
-	handleSubmodules(true)
+// gitTime and gitCalls total the git commands run, for --timings.
+var (
+	gitTime  time.Duration
+	gitCalls int
+)
+
+// cliRunner runs git through runner the way the command line wants: commands
+// that change the repository are echoed along with their output unless
+// quiet, and every command is when verbose. In dry-run mode, commands that
+// would change the repository are echoed and skipped. Echoes go to w.
+type cliRunner struct {
+	verbose verbosity
+	w       io.Writer
 }
 
-func pushOrigin(verbose bool) {
-	branch := getCurrBranch(verbose)
-	rungit([]string{"push", "-f", "origin", branch}, true)
+// echoes reports whether c prints cmdargs and its output.
+func (c cliRunner) echoes(cmdargs []string) bool {
+	switch c.verbose {
+	case verbosityVerbose:
+		return true
+	case verbosityNormal:
+		// update-ref only moves git_ext's own bookkeeping refs.
+		return !isReadOnly(cmdargs) && cmdargs[0] != "update-ref"
+	}
+	return false
 }
 
-type branchT struct {
-	Desc        branchDescriptor
-	Downstream  []*branchT
-	HasUpstream bool
+// strictClean is set by --strict-clean to have untracked files keep the
+// working tree from counting as clean.
+var strictClean bool
+
+// StrictClean implements gitext.StrictCleaner.
+func (c cliRunner) StrictClean() bool {
+	return strictClean
 }
 
-type branchDescriptor struct {
-	Current  bool
-	Name     string
-	Sha      string
-	Upstream string
-	Status   string
-	Message  string
+// stashSkipped is set when --dry-run skips --autostash's stash, so that the
+// rest of the dry run goes ahead as though it had happened.
+var stashSkipped bool
+
+// AssumeClean implements gitext.AssumeCleaner.
+func (c cliRunner) AssumeClean() bool {
+	return stashSkipped
 }
 
-func parseBranchEntry(branchEntry string) branchDescriptor {
-	descriptor := branchDescriptor{}
-	descriptor.Current = string(branchEntry[0]) == "*"
-	whitespace := regexp.MustCompile("\\s+")
-	parts := whitespace.Split(strings.TrimLeft(branchEntry, "* "), 3)
-	descriptor.Name = parts[0]
-	descriptor.Sha = parts[1]
-	rest := parts[2]
+func (c cliRunner) Run(cmdargs []string) (string, error) {
+	return c.RunWithEnv(nil, cmdargs)
+}
 
-	restExpr := regexp.MustCompile(`(?:\[([^\]]*)\] )?(.*)`)
-	m := restExpr.FindStringSubmatch(rest)
-	if m == nil {
-		panic(fmt.Sprintf("Unexpectedly unable to parse branch line %s\n", branchEntry))
+func (c cliRunner) RunWithEnv(env []string, cmdargs []string) (string, error) {
+	skip := dryRun && !isReadOnly(cmdargs)
+	echo := c.echoes(cmdargs)
+	cmdline := gitCmd + " " + strings.Join(cmdargs, " ")
+	if len(env) > 0 {
+		cmdline = strings.Join(env, " ") + " " + cmdline
+	}
+	cmdline = colorize("cmd", "white+b:green") + " " + cmdline
+	if skip {
+		fmt.Fprintln(c.w, cmdline)
+		logGitCall(gitLogEntry{Args: cmdargs, DryRun: true}, time.Now())
+		return "", nil
+	}
+	// With --verbose, the command is printed once it's done, with how long
+	// it took, and so is whatever git wrote to stderr even if it succeeded.
+	timed := c.verbose == verbosityVerbose
+	if echo && !timed {
+		fmt.Fprintln(c.w, cmdline)
+	}
+	var stderr bytes.Buffer
+	if timed {
+		gitStderr = &stderr
+		defer func() { gitStderr = nil }()
+	}
+	start := time.Now()
+	var cmdOutput string
+	var err error
+	if len(env) == 0 {
+		cmdOutput, err = runner.Run(cmdargs)
+	} else if envRunner, ok := runner.(gitext.EnvRunner); ok {
+		cmdOutput, err = envRunner.RunWithEnv(env, cmdargs)
 	} else {
-		descriptor.Message = m[2]
-		upstreamAndMaybeStatus := strings.Split(m[1], ": ")
-		descriptor.Upstream = upstreamAndMaybeStatus[0]
-		if len(upstreamAndMaybeStatus) > 1 {
-			descriptor.Status = upstreamAndMaybeStatus[1]
+		err = fmt.Errorf("unable to set the environment for git %s", strings.Join(cmdargs, " "))
+	}
+	elapsed := time.Since(start)
+	gitTime += elapsed
+	gitCalls++
+	if timed {
+		fmt.Fprintf(c.w, "%s (%.2fs)\n", cmdline, elapsed.Seconds())
+	}
+	if err != nil {
+		return "", err
+	}
+	if echo {
+		fmt.Fprintln(c.w, cmdOutput)
+	}
+	if timed && stderr.Len() > 0 {
+		fmt.Fprintln(c.w, strings.TrimRight(stderr.String(), "\n"))
+	}
+	return cmdOutput, nil
+}
+
+// inAlias is set while an alias's steps run, so that they share the runner
+// runAlias set up rather than each wrapping it again.
+var inAlias = false
+
+// setUpRunner applies --retries, --log, and --timings to every git command
+// run from here on. The returned func closes the log and prints the timings,
+// and is called once the command is done.
+func setUpRunner(w io.Writer, errW io.Writer, retries string, logPath string, timings bool) (func(), error) {
+	if n, err := strconv.Atoi(retries); err != nil || n < 0 {
+		return nil, newUsageError("--retries must be a non-negative integer, got %q", retries)
+	} else if n > 0 {
+		runner = gitext.RetryRunner{Runner: runner, Retries: n, OnRetry: func(args []string, attempt int, delay time.Duration, err error) {
+			warnRetry(errW, args, attempt, delay, err)
+		}}
+	}
+	var logFile *os.File
+	if logPath != "" {
+		var err error
+		if logFile, err = openGitLog(logPath); err != nil {
+			return nil, err
 		}
 	}
-	return descriptor
+	return func() {
+		if logFile != nil {
+			logFile.Close()
+		}
+		if timings {
+			fmt.Fprintf(w, "ran %d git commands in %.2fs\n", gitCalls, gitTime.Seconds())
+		}
+	}, nil
+}
+
+// rungit runs git through a cliRunner at the given verbosity, trimming the
+// whitespace around its output.
+func rungit(w io.Writer, cmdargs []string, verbose verbosity) (string, error) {
+	output, err := cliRunner{verbose, w}.Run(cmdargs)
+	return strings.TrimSpace(output), err
 }
 
-var indentAmount = 2
+// remoteName is the remote that po and push-stack push to and that sync's
+// stacks are based on, as set by --origin.
+var remoteName = "origin"
+
+// assumeYes is set by --yes (or --force) to skip confirmation prompts.
+var assumeYes = false
+
+// noVerify is set by --no-verify to skip commit hooks on the commits git_ext
+// makes.
+var noVerify = false
 
-func prefixForDepth(depth int) string {
-	return strings.Repeat(" ", indentAmount*depth) + "+-- "
+var errResetDeclined = errors.New("reset cancelled")
+
+// confirmReset returns the hook that asks, on w, before a `reset --hard` to
+// target, showing the commit being left behind. Without a terminal to ask on,
+// it requires --yes.
+func confirmReset(w io.Writer) func(target string, head string) error {
+	return func(target string, head string) error {
+		if assumeYes || dryRun {
+			return nil
+		}
+		if !stdinIsTerminal() {
+			return newUsageError("not resetting to %s without confirmation; pass --yes to skip the prompt", target)
+		}
+		ok, err := confirm(w, fmt.Sprintf("Reset --hard to %s, leaving HEAD at %s?", target, head))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errResetDeclined
+		}
+		return nil
+	}
 }
 
-func printTreeRootedAt(w io.Writer, root *branchT, currDepth int) {
-	if currDepth == 0 {
-		outputLine := prefixForDepth(currDepth) + root.Desc.Upstream
-		if strings.HasPrefix(root.Desc.Upstream, "origin") {
-			fmt.Fprintln(w, ansi.Color(outputLine+"\t\t\t", "blue"))
-		} else {
-			fmt.Fprintln(w, ansi.Color(outputLine+" [missing]\t\t\t", "red"))
+// withAutostash runs op, first stashing any uncommitted changes if autostash
+// is set and the working tree is dirty. The stash is popped afterward whether
+// or not op succeeds.
+func withAutostash(w io.Writer, autostash bool, verbose verbosity, op func() error) error {
+	if !autostash {
+		return op()
+	}
+	clean, err := gitext.IsClean(cliRunner{verbose, w})
+	if err != nil {
+		return err
+	}
+	if clean {
+		return op()
+	}
+	if _, err := rungit(w, []string{"stash", "push", "--include-untracked", "-m", "git_ext autostash"}, verbose); err != nil {
+		return err
+	}
+	if dryRun {
+		stashSkipped = true
+		defer func() { stashSkipped = false }()
+	}
+	opErr := op()
+	if _, err := rungit(w, []string{"stash", "pop"}, verbose); err != nil {
+		fmt.Fprintln(w, colorize("Unable to restore your stashed changes; they're still saved in the stash.", "white:red"))
+		fmt.Fprintln(w, `Resolve any conflicts and run "git stash pop" (or "git stash drop" once they're applied).`)
+		if opErr == nil {
+			opErr = err
 		}
-		printTreeRootedAt(w, root, currDepth+1)
-		return
 	}
-	prefix := prefixForDepth(currDepth) + root.Desc.Name
-	outputLine := prefix + "\t" + root.Desc.Sha + "\t" + root.Desc.Message + "\t"
-	fmt.Fprintln(w, outputLine)
-	for _, ds := range root.Downstream {
-		printTreeRootedAt(w, ds, currDepth+1)
+	return opErr
+}
+
+// submodules is how commands bring submodules along when they move HEAD, as
+// set by --no-submodules, --submodules-best-effort, and --jobs.
+var submodules gitext.SubmoduleOptions
+
+// topLevel caches the repository's top-level directory. Once it's known,
+// git runs from there rather than from the current directory.
+var topLevel string
+
+// workDir is where git runs until topLevel is known: the directory given to
+// -C, or the current directory if it's empty.
+var workDir string
+
+// resolvePath makes a relative path from the command line relative to the
+// directory given to -C, like git's own path arguments, rather than to where
+// git_ext was started.
+func resolvePath(path string) string {
+	if workDir == "" || path == "" || filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(workDir, path)
 }
 
-func drawBranchTree() {
-	branches := strings.Split(rungit([]string{"branch", "-vv"}, false), "\n")
-	branchMap := map[string]*branchT{}
-	for _, br := range branches {
-		desc := parseBranchEntry(br)
-		branchMap[desc.Name] = &branchT{Desc: desc, Downstream: []*branchT{}, HasUpstream: false}
+var errNotInRepo error = &usageError{msg: "not inside a git repository"}
+
+func repoTopLevel(git gitext.Runner) (string, error) {
+	if topLevel != "" {
+		return topLevel, nil
+	}
+	dir, err := git.Run([]string{"rev-parse", "--show-toplevel"})
+	if err != nil {
+		return "", err
 	}
-	for _, br := range branchMap {
-		if upstreamBranch, exists := branchMap[br.Desc.Upstream]; exists {
-			upstreamBranch.Downstream = append(branchMap[br.Desc.Upstream].Downstream, br)
-			branchMap[br.Desc.Upstream] = upstreamBranch
-			br.HasUpstream = true
+	topLevel = strings.TrimSpace(dir)
+	return topLevel, nil
+}
+
+// validateRef returns an error naming name if it doesn't resolve to a commit,
+// so commands can fail before touching anything rather than partway through
+// with git's error.
+func validateRef(git gitext.Runner, name string) error {
+	exists, err := gitext.RefExists(git, name+"^{commit}")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no such branch/ref: %s", name)
+	}
+	return nil
+}
+
+// validateNewBranch returns an error if a branch named name already exists.
+func validateNewBranch(git gitext.Runner, name string) error {
+	exists, err := gitext.RefExists(git, "refs/heads/"+name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("a branch named %s already exists", name)
+	}
+	return nil
+}
+
+// ensureBranch creates branch at startPoint (or HEAD, if startPoint is empty)
+// unless it already exists.
+func ensureBranch(w io.Writer, branch string, startPoint string, verbose verbosity) error {
+	exists, err := gitext.RefExists(cliRunner{verbose, w}, branch)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if verbose != verbosityQuiet {
+			fmt.Fprintln(w, "using existing branch "+branch)
 		}
+		return nil
+	}
+	cmdargs := []string{"branch", branch}
+	if startPoint != "" {
+		cmdargs = append(cmdargs, startPoint)
+	}
+	if _, err := rungit(w, cmdargs, verbose); err != nil {
+		return err
+	}
+	if verbose != verbosityQuiet {
+		fmt.Fprintln(w, "created new branch "+branch)
+	}
+	return nil
+}
+
+// syncBranches fixes up every branch in the stacks rooted on remoteName,
+// upstreams first, then returns to the starting branch. If a fix-up fails the
+// repo is left as-is so the failure can be resolved.
+func syncBranches(w io.Writer, opts gitext.FixUpOptions, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	startBranch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	rootBranches, _, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
 	}
-	w := new(tabwriter.Writer)
-	outputBuffer := bytes.Buffer{}
-	w.Init(&outputBuffer, 5, 0, 1, ' ', 0)
-	rootBranches := []*branchT{}
-	for _, br := range branchMap {
-		if !br.HasUpstream {
-			rootBranches = append(rootBranches, br)
+	remoteRoots := []*gitext.Branch{}
+	for _, root := range rootBranches {
+		if strings.HasPrefix(root.Desc.Upstream, remoteName+"/") {
+			remoteRoots = append(remoteRoots, root)
 		}
 	}
+	if err := fixUpEach(w, gitext.StackOrder(remoteRoots), "sync", opts, verbose); err != nil {
+		return err
+	}
+	return gitext.Checkout(cliRunner{verbose.steps(), w}, startBranch, submodules)
+}
 
-	sort.Slice(rootBranches, func(i, j int) bool {
-		return rootBranches[i].Desc.Name < rootBranches[j].Desc.Name
+// fixUpAll fixes up every local branch that has an upstream, in name order
+// rather than stack order, then returns to the starting branch. Branches whose
+// upstream is gone, or that are checked out in another worktree, are skipped
+// and reported.
+func fixUpAll(w io.Writer, opts gitext.FixUpOptions, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	startBranch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range branchMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	branches := []*gitext.Branch{}
+	for _, name := range names {
+		br := branchMap[name]
+		switch {
+		case br.Desc.Upstream == "":
+		case br.Desc.Status == "gone":
+			fmt.Fprintln(w, colorize("skipping "+name+" since its upstream "+br.Desc.Upstream+" is gone", "yellow"))
+		case br.Desc.Worktree:
+			fmt.Fprintln(w, colorize("skipping "+name+" since it's checked out in "+br.Desc.WorktreePath, "yellow"))
+		default:
+			branches = append(branches, br)
+		}
+	}
+	if err := fixUpEach(w, branches, "fu --all", opts, verbose); err != nil {
+		return err
+	}
+	return gitext.Checkout(cliRunner{verbose.steps(), w}, startBranch, submodules)
+}
+
+// fixUpEach checks out and fixes up each of branches in turn, printing
+// progress. If one fails, it says where command stopped and leaves the repo
+// there so the failure can be resolved.
+func fixUpEach(w io.Writer, branches []*gitext.Branch, command string, opts gitext.FixUpOptions, verbose verbosity) error {
+	git := cliRunner{verbose.steps(), w}
+	for i, br := range branches {
+		printProgress(w, i+1, len(branches), br.Desc.Name, verbose)
+		if err := gitext.Checkout(git, br.Desc.Name, submodules); err != nil {
+			return err
+		}
+		if err := gitext.FixUpstream(git, br.Desc.Upstream, opts); err != nil {
+			fmt.Fprintln(w, colorize(command+" stopped at "+br.Desc.Name, "white:red"))
+			return err
+		}
+	}
+	return nil
+}
+
+// amendBranch amends the current branch's last commit with what's staged,
+// rewording it if message is given, then fixes up every branch stacked on it
+// and returns to it.
+func amendBranch(w io.Writer, message string, opts gitext.FixUpOptions, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	branch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	if err := gitext.EnsureNoOperationInProgress(git); err != nil {
+		return err
+	}
+	if _, err := rungit(w, []string{"diff", "--quiet"}, verbose); err != nil {
+		if gitErr, ok := err.(*gitext.GitError); ok && gitErr.ExitCode == 1 {
+			return gitext.ErrUnstagedChanges
+		}
+		return err
+	}
+	cmdargs := []string{"commit", "--amend", "--no-edit"}
+	if message != "" {
+		cmdargs = []string{"commit", "--amend", "-m", message}
+	}
+	if noVerify {
+		cmdargs = append(cmdargs, "--no-verify")
+	}
+	if _, err := rungit(w, cmdargs, verbose); err != nil {
+		return err
+	}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	br, ok := branchMap[branch]
+	if !ok || len(br.Downstream) == 0 {
+		return nil
+	}
+	if err := fixUpEach(w, gitext.StackOrder(br.Downstream), "amend", opts, verbose); err != nil {
+		return err
+	}
+	return gitext.Checkout(cliRunner{verbose.steps(), w}, branch, submodules)
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no.
+func confirm(w io.Writer, prompt string) (bool, error) {
+	fmt.Fprint(w, prompt+" [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// pruneBranches deletes local branches whose upstream no longer exists. The
+// current branch is never deleted. Unless skipConfirm is set, it asks before
+// deleting anything.
+func pruneBranches(w io.Writer, skipConfirm bool, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	candidates := []string{}
+	for name, br := range branchMap {
+		if br.Desc.Upstream == "" || br.HasUpstream {
+			continue
+		}
+		gone := br.Desc.Status == "gone"
+		if !gone {
+			exists, err := gitext.RefExists(git, br.Desc.Upstream)
+			if err != nil {
+				return err
+			}
+			gone = !exists
+		}
+		if !gone {
+			continue
+		}
+		if br.Desc.Current {
+			fmt.Fprintln(w, colorize("not pruning "+name+" since it's checked out; its upstream "+br.Desc.Upstream+" is gone", "yellow"))
+			continue
+		}
+		candidates = append(candidates, name)
+	}
+	sort.Strings(candidates)
+	if len(candidates) == 0 {
+		fmt.Fprintln(w, "no branches to prune")
+		return nil
+	}
+	for _, name := range candidates {
+		fmt.Fprintln(w, name+" (upstream "+branchMap[name].Desc.Upstream+" is gone)")
+	}
+	if dryRun {
+		return nil
+	}
+	if !skipConfirm {
+		ok, err := confirm(w, fmt.Sprintf("Delete %d branches?", len(candidates)))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	for _, name := range candidates {
+		if _, err := rungit(w, []string{"branch", "-D", name}, verbose); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanMerged deletes the local branches fully merged into base, as listed
+// by git branch --merged. The current branch, base itself (or, for a
+// remote-tracking base like origin/main, the local main), and branches
+// checked out in other worktrees are never deleted. Unless skipConfirm is
+// set, it asks before deleting anything.
+func cleanMerged(w io.Writer, base string, skipConfirm bool, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	if exists, err := gitext.RefExists(git, base+"^{commit}"); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("no branch or commit named %s", base)
+	}
+	baseBranch := strings.TrimPrefix(base, "refs/heads/")
+	if remote, err := gitext.RemoteOf(git, base); err != nil {
+		return err
+	} else if remote != "" {
+		baseBranch = strings.TrimPrefix(base, remote+"/")
+	}
+	output, err := rungit(w, []string{"branch", "--merged", base}, verbosityQuiet)
+	if err != nil {
+		return err
+	}
+	candidates := []string{}
+	if output != "" {
+		for _, line := range strings.Split(output, "\n") {
+			desc, err := parseBranchEntry(line)
+			if err != nil {
+				return err
+			}
+			switch {
+			case desc.Detached, desc.Name == base, desc.Name == baseBranch:
+			case desc.Current:
+				fmt.Fprintln(w, colorize("not deleting "+desc.Name+" since it's checked out", "yellow"))
+			case desc.Worktree:
+				fmt.Fprintln(w, colorize("not deleting "+desc.Name+" since it's checked out in another worktree", "yellow"))
+			default:
+				candidates = append(candidates, desc.Name)
+			}
+		}
+	}
+	sort.Strings(candidates)
+	if len(candidates) == 0 {
+		fmt.Fprintln(w, "no branches merged into "+base+" to delete")
+		return nil
+	}
+	for _, name := range candidates {
+		fmt.Fprintln(w, name+" (merged into "+base+")")
+	}
+	if dryRun {
+		return nil
+	}
+	if !skipConfirm {
+		ok, err := confirm(w, fmt.Sprintf("Delete %d branches?", len(candidates)))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	for _, name := range candidates {
+		// -D since -d checks against the branch's upstream, which may not be base.
+		if _, err := rungit(w, []string{"branch", "-D", name}, verbose); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameBranch renames oldName to newName, keeping its upstream, and points
+// every branch that tracked oldName at newName.
+func renameBranch(w io.Writer, oldName string, newName string, verbose verbosity) error {
+	_, branchMap, err := gitext.BranchTree(cliRunner{verbose, w})
+	if err != nil {
+		return err
+	}
+	br, ok := branchMap[oldName]
+	if !ok || br.Desc.Remote {
+		return fmt.Errorf("no local branch named %s", oldName)
+	}
+	if _, err := rungit(w, []string{"branch", "-m", oldName, newName}, verbose); err != nil {
+		return err
+	}
+	if upstream := br.Desc.Upstream; upstream != "" {
+		if _, err := rungit(w, []string{"branch", "--set-upstream-to", upstream, newName}, verbose); err != nil {
+			return err
+		}
+	}
+	for _, downstream := range br.Downstream {
+		if _, err := rungit(w, []string{"branch", "--set-upstream-to", newName, downstream.Desc.Name}, verbose); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveBranch re-parents branch onto newUpstream and fixes it up there, then
+// returns to the branch that was checked out. If the fix-up stops with
+// conflicts it's aborted, leaving branch as it was, upstream included, so
+// that the original branch can be restored.
+func moveBranch(w io.Writer, branch string, newUpstream string, opts gitext.FixUpOptions, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	startBranch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	if branch == startBranch {
+		return gitext.FixUpstream(git, newUpstream, opts)
+	}
+	if err := gitext.EnsureClean(git); err != nil {
+		return err
+	}
+	oldUpstream, err := gitext.UpstreamOrNone(git, branch)
+	if err != nil {
+		return err
+	}
+	if err := gitext.Checkout(git, branch, submodules); err != nil {
+		return err
+	}
+	fixErr := gitext.FixUpstream(git, newUpstream, opts)
+	if conflict, ok := fixErr.(*gitext.ConflictError); ok {
+		// Unless --on-conflict said otherwise, FixUpstream has already put
+		// the branch back.
+		if !conflict.Aborted {
+			if err := gitext.AbortFixUp(git, submodules); err != nil {
+				// The conflicts are still checked out, so stay here.
+				return fmt.Errorf("%v\nunable to abort: %v", fixErr, err)
+			}
+		}
+		fixErr = fmt.Errorf("moving %s onto %s stopped with conflicts, so %s was put back on its original commit; check it out and run \"git_ext up %s\" to resolve them", branch, newUpstream, branch, newUpstream)
+		if err := gitext.SetUpstream(git, branch, oldUpstream); err != nil {
+			fixErr = fmt.Errorf("%v\nunable to restore %s's upstream %s: %v", fixErr, branch, oldUpstream, err)
+		}
+	}
+	if err := gitext.Checkout(git, startBranch, submodules); err != nil {
+		if fixErr != nil {
+			return fmt.Errorf("%v\nunable to return to %s: %v", fixErr, startBranch, err)
+		}
+		return err
+	}
+	return fixErr
+}
+
+// moveBranches moves each of branches onto newUpstream with moveBranch,
+// upstreams before the branches stacked on them. Every branch and the target
+// are checked before anything moves, and it stops at the first branch that
+// can't be moved.
+func moveBranches(w io.Writer, branches []string, newUpstream string, opts gitext.FixUpOptions, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	if err := validateRef(git, newUpstream); err != nil {
+		return err
+	}
+	targetChain := []string{newUpstream}
+	if _, ok := branchMap[newUpstream]; ok {
+		if targetChain, err = gitext.ChainToRoot(branchMap, newUpstream); err != nil {
+			return err
+		}
+	}
+	depths := map[string]int{}
+	for _, branch := range branches {
+		if _, ok := depths[branch]; ok {
+			continue
+		}
+		if br, ok := branchMap[branch]; !ok || br.Desc.Remote {
+			return fmt.Errorf("no local branch named %s", branch)
+		}
+		for _, name := range targetChain {
+			if name == branch {
+				return fmt.Errorf("can't move %s onto %s, which is stacked on it", branch, newUpstream)
+			}
+		}
+		chain, err := gitext.ChainToRoot(branchMap, branch)
+		if err != nil {
+			return err
+		}
+		depths[branch] = len(chain)
+	}
+	ordered := []string{}
+	for branch := range depths {
+		ordered = append(ordered, branch)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if depths[ordered[i]] != depths[ordered[j]] {
+			return depths[ordered[i]] < depths[ordered[j]]
+		}
+		return ordered[i] < ordered[j]
 	})
+	if len(ordered) == 1 {
+		return moveBranch(w, ordered[0], newUpstream, opts, verbose)
+	}
+	for i, branch := range ordered {
+		printProgress(w, i+1, len(ordered), branch, verbose)
+		if err := moveBranch(w, branch, newUpstream, opts, verbose.steps()); err != nil {
+			if i > 0 {
+				return fmt.Errorf("%v\nmoved %s before stopping", err, strings.Join(ordered[:i], ", "))
+			}
+			return err
+		}
+	}
+	return nil
+}
 
-	for _, br := range rootBranches {
-		printTreeRootedAt(w, br, 0)
+// commitBranch moves the last commit onto a new branch, leaving the current
+// branch at HEAD~1. If message, prefix, or trailers are given, the extracted
+// commit is reworded. If track is set, the new branch's upstream is the
+// branch it was extracted from.
+func commitBranch(w io.Writer, branchName string, message string, prefix string, trailers []string, track bool, verbose verbosity) error {
+	opts := gitext.CommitBranchOptions{
+		Message:      message,
+		Prefix:       prefix,
+		Trailers:     trailers,
+		Track:        track,
+		Submodules:   submodules,
+		ConfirmReset: confirmReset(w),
+		NoVerify:     noVerify,
+	}
+	if dryRun {
+		return previewCommitBranch(w, branchName, opts)
+	}
+	git := cliRunner{verbose, w}
+	if track {
+		if _, detached, err := gitext.CurrentBranch(git); err != nil {
+			return err
+		} else if detached {
+			fmt.Fprintln(w, colorize("not setting an upstream for "+branchName+" since HEAD is detached", "yellow"))
+		}
 	}
+	return gitext.CommitBranch(git, branchName, opts)
+}
 
-	w.Flush()
-	output := outputBuffer.String()
-	// Finally, we need to highlight the current branch in green.
-	// We couldn't do this earlier since the nonprinting escape characters
-	// count as characters for balancing columns.
-	branchExtractRe := regexp.MustCompile("\\+-- ([^\\s]+)")
-	for _, line := range strings.Split(output, "\n") {
-		match := branchExtractRe.FindStringSubmatch(line)
-		if match == nil {
+// previewCommitBranch is commitBranch's --dry-run: it describes the commits
+// involved rather than listing the git commands it would run.
+func previewCommitBranch(w io.Writer, branchName string, opts gitext.CommitBranchOptions) error {
+	git := cliRunner{verbosityQuiet, w}
+	describe := func(ref string) (string, error) {
+		return rungit(w, []string{"log", "-n", "1", "--pretty=format:%h %s", ref, "--"}, verbosityQuiet)
+	}
+	if err := validateNewBranch(git, branchName); err != nil {
+		return err
+	}
+	if exists, err := gitext.RefExists(git, "HEAD~1"); err != nil {
+		return err
+	} else if !exists {
+		return errors.New("HEAD has no parent to reset to")
+	}
+	moving, err := describe("HEAD")
+	if err != nil {
+		return err
+	}
+	resetTo, err := describe("HEAD~1")
+	if err != nil {
+		return err
+	}
+	current, detached, err := gitext.CurrentBranch(git)
+	if err != nil {
+		return err
+	}
+	if detached {
+		current = "HEAD"
+	}
+	message, err := gitext.CommitBranchMessage(git, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "would create branch %s with %s\n", branchName, moving)
+	if message != "" {
+		fmt.Fprintf(w, "would reword that commit to %q\n", message)
+	}
+	for _, trailer := range opts.Trailers {
+		fmt.Fprintf(w, "would add the trailer %q to it\n", trailer)
+	}
+	if opts.Track && !detached {
+		fmt.Fprintf(w, "would set the upstream of %s to %s\n", branchName, current)
+	}
+	fmt.Fprintf(w, "would reset %s to %s\n", current, resetTo)
+	fmt.Fprintf(w, "would check out %s\n", branchName)
+	return nil
+}
+
+func pushOrigin(w io.Writer, verbose verbosity) error {
+	branch, err := gitext.RequireBranch(cliRunner{verbose, w})
+	if err != nil {
+		return err
+	}
+	_, err = rungit(w, []string{"push", "-f", remoteName, branch}, verbose)
+	return err
+}
+
+// pushStack force-pushes (with lease) every branch in the current branch's
+// stack that's already on the stack's remote, upstreams first. Branches that
+// have never been pushed are left alone.
+func pushStack(w io.Writer, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	currBranch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	chain, err := gitext.ChainToRoot(branchMap, currBranch)
+	if err != nil {
+		return err
+	}
+	root, ok := branchMap[chain[0]]
+	if !ok {
+		root = branchMap[chain[1]]
+	}
+	remote, err := gitext.RemoteOf(git, root.Desc.Upstream)
+	if err != nil {
+		return err
+	}
+	if remote == "" {
+		remote = remoteName
+	}
+	pushed, skipped := []string{}, []string{}
+	for _, br := range gitext.StackOrder([]*gitext.Branch{root}) {
+		name := br.Desc.Name
+		onRemote, err := gitext.RefExists(git, "refs/remotes/"+remote+"/"+name)
+		if err != nil {
+			return err
+		}
+		if !onRemote {
+			skipped = append(skipped, name)
 			continue
 		}
-		lineBranch := match[1]
-		if brT, exists := branchMap[lineBranch]; exists && brT.Desc.Current {
-			fmt.Println(ansi.Color(line, "green"))
-		} else {
-			fmt.Println(line)
+		if _, err := rungit(w, []string{"push", "--force-with-lease", remote, name + ":" + name}, verbose); err != nil {
+			return err
+		}
+		pushed = append(pushed, name)
+	}
+	if verbose != verbosityQuiet {
+		verb := "pushed"
+		if dryRun {
+			verb = "would push"
 		}
+		fmt.Fprintf(w, "%s to %s: %s\n", verb, remote, listOrNone(pushed))
+		fmt.Fprintf(w, "skipped (not on %s): %s\n", remote, listOrNone(skipped))
 	}
+	return nil
 }
 
-func main() {
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// run parses the command line and runs the command, writing its output to w
+// and warnings to errW.
+func run(w io.Writer, errW io.Writer) error {
+	return runArgs(w, errW, os.Args[1:])
+}
+
+// runArgs is run for the arguments argv, which may come from an alias.
+func runArgs(w io.Writer, errW io.Writer, argv []string) error {
 	usage := `git_ext - a grab bag of git shortcuts
 
 Usage:
-	git_ext [--verbose] (lh | lasthash)
-	git_ext [--verbose] shup | show_up
-	git_ext [--verbose] fu | fix_up | fix_upstream
-	git_ext [--verbose] up <branch>
-	git_ext [--verbose] (rup | rec_fix_up) <terminal_branch>
-	git_ext [--verbose] (cbr | commit_br) <branch>
-	git_ext [--verbose] tree | show_tree
-	git_ext [--verbose] po | push_origin
+	git_ext [options] (lh | lasthash) [--short | --format=<fmt>]
+	git_ext [options] shup | show_up
+	git_ext [options] (fu | fix_up | fix_upstream) [--continue | --abort | --all]
+	git_ext [options] up [--create [--from=<start>]] [--onto=<ref> | --latest] [<branch>]
+	git_ext [options] (rup | rec_fix_up) <terminal_branch>
+	git_ext [options] (cbr | commit_br) [-m <message>] [--prefix=<text>] [--trailer=<trailer>...] [<branch>]
+	git_ext [options] amend [-m <message>]
+	git_ext [options] (fixup-commit | fixup_commit) <ref> [--squash-now]
+	git_ext [options] (tree | show_tree) [--json | --porcelain | --format=<fmt> | --template=<tmpl>] [--depth=<n>] [--indent=<n>] [--abbrev=<n>] [--remote] [--pattern=<glob>] [--root=<branch>] [--sort=<key>] [--descriptions] [--show-dates] [--show-authors] [--collapse-clean]
+	git_ext [options] po | push_origin
+	git_ext [options] push-stack | push_stack
+	git_ext [options] sync
+	git_ext [options] (rebase-stack | rebase_stack) --onto=<ref>
+	git_ext [options] status
+	git_ext [options] (current | cur)
+	git_ext [options] (log-stack | log_stack) [--patch]
+	git_ext [options] undo
+	git_ext [options] prune
+	git_ext [options] (clean-merged | clean_merged) --into=<base>
+	git_ext [options] rename <old> <new>
+	git_ext [options] move <branches>... --onto=<upstream>
+	git_ext [options] list [--current | --all] [--json]
+	git_ext [options] (leaves | branches) [--json]
+	git_ext [options] stashes [--current]
+	git_ext [options] doctor
+	git_ext [options] config get <key>
+	git_ext [options] config set <key> <value>
+	git_ext [options] root-of <branch> [--chain]
+	git_ext [options] apply-stack <file> [--sync]
+	git_ext [options] workspace save <name>
+	git_ext [options] workspace checkout <name>
+	git_ext [options] workspace list
+	git_ext [options] export <dir>
+	git_ext [options] import <dir> [--3way]
+	git_ext completion <shell>
 
 Options:
 	--verbose  		Show extra output?
+	-C <path>  		Run as if git_ext was started in <path> instead of the current directory; relative <file> and <dir> arguments and --log are taken relative to it too
+	-q, --quiet  		Only print errors and the results of read-only commands
+	--color=<when>  	Color output: always, never, or auto (when stdout is a terminal and NO_COLOR isn't set; the default)
+	--timings  		Print how long was spent running git once the command finishes
+	--origin=<name>  	The remote to push to and to expect stacks to be based on (default: origin). It's not
+	                 	called --remote since tree --remote already means something else
+	--retries=<n>  		Retry fetch, push, and submodule commands that fail with a network error up to n times [default: 0]
+	--log=<file>  		Append a JSON line describing every git command run to <file>
+	--dry-run  		Print the git commands that would modify the repo instead of running them
+	--format=<fmt>  	For tree, the output format: text (the default), json, porcelain, dot, or mermaid.
+	                	For lh, a git log pretty format (default: %H)
+	--short  		For lh, print the abbreviated hash
+	--json  		For tree, shorthand for --format=json; for list and leaves, print JSON
+	--template=<tmpl>  	For tree, render each branch with this Go text/template, indented by depth, e.g.
+	                   	'{{.Name}} {{short .Sha}} {{.Message}}'; fields are those of the JSON output
+	--porcelain  		For tree, shorthand for --format=porcelain: tab-separated depth, name, sha, upstream, ahead, behind, and current (1 or 0), in a stable order
+	--current  		For list, describe the current branch (the default); for stashes, only list the current branch's
+	--all  		For list, describe every local branch; for fu, fix up every local branch that has an upstream
+	--chain  		For root-of, print every branch from the root down to <branch>
+	--sync  		For apply-stack, run sync once the upstreams are set
+	--depth=<n>  		For tree, only show this many levels of branches under each root
+	--remote  		For tree, include remote-tracking branches as nodes
+	--pattern=<glob>  	For tree, only show branches matching this glob (and the branches above them)
+	--root=<branch>  	For tree, only show the branches under this branch or upstream
+	--collapse-clean  	For tree, hide branches level with their upstream (but not the current branch)
+	--descriptions  	For tree, show each branch's description (git branch --edit-description)
+	--show-dates  		For tree, show how long ago each branch's tip was committed
+	--show-authors  	For tree, show who wrote each branch's tip
+	--sort=<key>  		For tree, order branches by name (the default), sha, or ahead
+	--abbrev=<n>  		For tree, show this many characters of each sha (JSON always has the full sha) [default: 7]
+	--indent=<n>  		For tree, number of spaces to indent each level (default: 2)
+	--no-submodules  	Don't init or update submodules after changing commits
+	--submodules-best-effort  	Report submodule errors but carry on with the command
+	--jobs=<n>  		Update up to n submodules in parallel
+	--strict-clean  	Count untracked files as uncommitted changes, which commands refuse to run with
+	--autostash  		Stash uncommitted changes before a destructive command and restore them after
+	--fetch  		Fetch the upstream's remote before fixing up
+	--latest  		For up, fetch just the upstream's branch from its remote (failing if that fails) and fix up onto it
+	--last-only  		Only carry over the branch's last commit when fixing up
+	--on-conflict=<how>  	When fixing up stops with conflicts: abort (the default) puts the branch back, keep leaves
+	                     	them to resolve, and ours or theirs pass -X ours or -X theirs to git so conflicting hunks
+	                     	take the upstream's or the branch's side (conflicts that can't settle still stop)
+	--verify  		After fixing up, check that the branch is on its upstream and each commit makes the same changes as before
+	--max-depth=<n>  	For rup, give up after following this many upstreams (default: 100)
+	--rebase  		Fix up by rebasing onto the upstream rather than resetting and cherry-picking
+	--continue  		For fu, finish a fix_up after resolving cherry-pick conflicts
+	--abort  		For fu, abandon a conflicted fix_up and restore the branch
+	-m <message>, --message=<message>  	For cbr, reword the extracted commit; for amend, the new message
+	--prefix=<text>  	For cbr, put <text> and a space in front of the extracted commit's message (or -m's)
+	--3way  		For import, let git am fall back on a three-way merge
+	--patch  		For log-stack, include each commit's diff
+	--trailer=<trailer>  	For cbr, add a trailer like "Stack-Id=42" to the extracted commit's message; repeatable
+	--track  		For cbr, set the new branch's upstream to the branch it was extracted from
+	--squash-now  		For fixup-commit, squash the fixup into <ref> right away with a non-interactive rebase
+	--no-verify  		Skip the pre-commit and commit-msg hooks on the commits cbr, amend, and fixup-commit make
+	-y, --yes  		Don't ask for confirmation before deleting branches or running reset --hard
+	-f, --force  		Same as --yes
+	--create  		For up, create the branch if it doesn't already exist
+	--from=<start>  	Start point for a branch created by --create (default: HEAD)
+	--into=<base>  		For clean-merged, the branch or remote-tracking branch to delete the branches merged into
+	--onto=<ref>  		For up, put the branch's commits on <ref> rather than the new upstream's tip.
+	            		For move, the branches' new upstream; for rebase-stack, the stack's new base
 
 Commands:
-	lh, lasthash                Print the most recent commit's hash
+	lh, lasthash                Print the most recent commit's hash (or other details, with --format)
 	shup, show_up               Print the upstream branch
-	fu, fix_up, fix_upstream    reset to just the lastest commit on top of the upstream branch
-	up                          set upstream, then run fix_up
+	fu, fix_up, fix_upstream    reset to the upstream branch, then cherry-pick the branch's own commits on top
+	up                          set upstream (default: default_upstream, else pick one interactively), then run fix_up (optionally creating it first)
 	rup, rec_fix_up             recursively apply fix_upstream from terminal_branch to this one
-	cbr, commit_br              create a new branch at the current commit, reset to HEAD~1, check out the new branch
+	cbr, commit_br              create a new branch at the current commit, reset to HEAD~1, check out the new branch (prompts for a name if none is given)
 	tree, show_tree             draw the current tree of branches
-	po, push_origin             force push to the branch of the same name on the origin
+	amend                       amend the last commit with what's staged, then fix up the branches stacked on this one
+	fixup-commit, fixup_commit  commit what's staged as a fixup! of <ref>, an ancestor of HEAD
+	po, push_origin             force push to the branch of the same name on the remote
+	push-stack, push_stack      force push (with lease) each branch in this stack that's already on the remote
+	sync                        run fix_up on every branch stacked on the remote, upstreams first
+	rebase-stack, rebase_stack  re-point the bottom of this stack at --onto, then fix up each branch up to this one
+	undo                        reset this branch to where it was before the last fix_up or commit_br
+	log-stack, log_stack        print the commits each branch from the bottom of this stack up to this one adds over its upstream
+	current, cur                print the branch, its ahead/behind counts and upstream, and the last commit on one line
+	status                      print a table of every branch's upstream, ahead/behind counts, and last commit
+	prune                       delete local branches whose upstream is gone
+	clean-merged, clean_merged  delete local branches fully merged into --into (never the current branch or the base)
+	rename                      rename a branch and re-point the branches tracking it
+	move                        set each branch's upstream and fix it up there, upstreams first, then return to this branch
+	list                        print the name, upstream, sha, and ahead/behind counts of branches
+	stashes                     list stashes grouped by the branch they were made on, the current branch's first
+	leaves, branches            print the branches at the tips of stacks, with their roots and ahead/behind counts
+	root-of                     print the remote or branch at the bottom of a branch's stack of upstreams
+	apply-stack                 set upstreams from a file of "parent child" lines, then optionally sync
+	workspace                   save this branch and its stack under a name, check a saved one out again, or list them
+	export                      write this stack's commits to <dir> as patches, with a manifest of which branch each belongs to
+	import                      recreate the branches exported to <dir>, applying their patches with git am
+	config                      get or set a key in .git_ext.yml
+	doctor                      check that the repository is in a state git_ext's commands expect
+	completion                  print a completion script for bash, zsh, or fish
+
+Environment:
+	GIT_EXT_GIT                 git executable to use (default: git on the PATH)
+	GIT_EXT_TIMEOUT             kill git commands that run longer than this duration, e.g. 30s
+	GIT_EXT_VERBOSE             overrides verbose from the config file
+	GIT_EXT_DEFAULT_UPSTREAM    overrides default_upstream from the config file
+	NO_COLOR                    disable colored output when set (unless --color=always)
+
+Exit status:
+	0   success
+	1   git (or other) error
+	2   usage error
+	3   the working tree isn't clean, or a rebase, merge, or the like is in progress
+	4   a cherry-pick stopped with conflicts
+	5   HEAD is detached
+	6   the upstreams form a cycle
+	130 interrupted (by Ctrl-C or SIGTERM)
+
+Configuration:
+	Defaults are read from .git_ext.yml, found by searching upward from the
+	repository root. Supported keys are verbose, default_upstream, color,
+	indent, and remote (the default for --origin); command line flags take
+	precedence. Use git_ext config to get or set them.
+
+	aliases maps names to sequences of commands separated by &&, e.g.
+	    aliases:
+	      refresh: git fetch && sync && push-stack
+	Then git_ext refresh runs each in turn, stopping at the first that fails.
+	Steps are git_ext commands, or git commands if they start with git; options
+	given before the alias apply to every step. Aliases can't replace commands.
 	`
 
-	args, err := docopt.Parse(usage, nil, true, "0.0.1", true)
-	if err != nil {
-		panic(err)
+	if err := resolveGit(); err != nil {
+		return err
+	}
+	if err := resolveTimeout(); err != nil {
+		return err
+	}
+	if ok, err := runAlias(w, errW, usage, argv); ok {
+		return err
+	}
+
+	args, err := docopt.Parse(usage, argv, true, "0.0.1", false, false)
+	if _, ok := err.(*docopt.UserError); ok {
+		// docopt has already printed the usage.
+		return &usageError{}
+	} else if err != nil {
+		return err
+	}
+	if args == nil {
+		// --help or --version was printed.
+		return nil
 	}
 
 	flag := func(names ...string) bool {
@@ -261,45 +1221,531 @@ Commands:
 		return false
 	}
 
-	verbose := flag("--verbose")
+	if dir, ok := args["-C"].(string); ok {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return newUsageError("-C: %s isn't a directory", dir)
+		}
+		workDir = dir
+	}
+
+	if !inAlias {
+		logPath, _ := args["--log"].(string)
+		finish, err := setUpRunner(w, errW, args["--retries"].(string), resolvePath(logPath), flag("--timings"))
+		if err != nil {
+			return err
+		}
+		defer finish()
+	}
+
+	// doctor reports on this itself, and completion doesn't need a repo.
+	if !flag("completion", "doctor") {
+		if _, err := repoTopLevel(cliRunner{verbosityQuiet, w}); err != nil {
+			if _, ok := err.(*gitext.GitError); !ok {
+				return err
+			} else if workDir != "" {
+				return newUsageError("-C: %s isn't inside a git repository", workDir)
+			}
+			return errNotInRepo
+		}
+	}
+
+	cfg, err := loadConfig(cliRunner{verbosityQuiet, w})
+	if err != nil {
+		return err
+	}
+
+	color, ok := args["--color"].(string)
+	if !ok {
+		color = cfg.Color
+	}
+	if err := setColor(w, color); err != nil {
+		return err
+	}
+
+	if remoteName, ok = args["--origin"].(string); !ok {
+		remoteName = "origin"
+		if cfg.Remote != "" {
+			remoteName = cfg.Remote
+		}
+	}
+
+	verbose := verbosityNormal
+	if flag("--quiet") {
+		verbose = verbosityQuiet
+	} else if flag("--verbose") || cfg.Verbose {
+		verbose = verbosityVerbose
+	}
+	autostash := flag("--autostash")
+	submodules.Skip = flag("--no-submodules")
+	submodules.BestEffort = flag("--submodules-best-effort")
+	submodules.Warn = func(err error) {
+		fmt.Fprintln(errW, colorize("ignoring submodule error: "+err.Error(), "yellow"))
+	}
+	if jobs, ok := args["--jobs"].(string); ok {
+		if submodules.Jobs, err = strconv.Atoi(jobs); err != nil || submodules.Jobs < 1 {
+			return newUsageError("--jobs must be a positive integer, got %q", jobs)
+		}
+	}
+	onConflict, _ := args["--on-conflict"].(string)
+	switch onConflict {
+	case "", "keep", "abort", "ours", "theirs":
+	default:
+		return newUsageError("--on-conflict must be keep, abort, ours, or theirs, got %q", onConflict)
+	}
+	fixUpOpts := gitext.FixUpOptions{
+		LastOnly:     flag("--last-only"),
+		Verify:       flag("--verify") && !flag("--dry-run"),
+		OnConflict:   onConflict,
+		Fetch:        flag("--fetch"),
+		Rebase:       flag("--rebase"),
+		Submodules:   submodules,
+		ConfirmReset: confirmReset(w),
+	}
+	git := cliRunner{verbose, w}
+	dryRun = flag("--dry-run")
+	assumeYes = flag("--yes", "--force")
+	noVerify = flag("--no-verify")
+	strictClean = flag("--strict-clean")
 
 	if flag("lh", "lasthash") {
-		fmt.Println(lasthash(verbose))
-		return
+		format, _ := args["--format"].(string)
+		if flag("--short") {
+			format = "%h"
+		} else if format == "" {
+			format = "%H"
+		}
+		hash, err := gitext.LastHash(git, format)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, hash)
+		return nil
 	}
 
 	if flag("shup", "show_upstream") {
-		fmt.Println(getUpstream(verbose))
-		return
+		upstream, err := gitext.Upstream(git)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, upstream)
+		return nil
 	}
 
 	if flag("fu", "fix_up", "fix_upstream") {
-		fixUpstream(getUpstream(verbose), verbose)
-		return
+		// A stopped rebase leaves HEAD detached, so these come first.
+		if flag("--continue") {
+			return gitext.ContinueFixUp(git, submodules)
+		}
+		if flag("--abort") {
+			err := gitext.AbortFixUp(git, submodules)
+			if err == gitext.ErrNoFixUpInProgress {
+				if op, opErr := gitext.OperationInProgress(git); opErr == nil && op != "" {
+					return fmt.Errorf("%v that git_ext started; this %s isn't one, so abort it with \"git %s --abort\"", err, op, op)
+				}
+			}
+			return err
+		}
+		if _, err := gitext.RequireBranch(git); err != nil {
+			return err
+		}
+		if flag("--all") {
+			return withAutostash(w, autostash, verbose, func() error {
+				return fixUpAll(w, fixUpOpts, verbose)
+			})
+		}
+		upstream, err := gitext.Upstream(git)
+		if err != nil {
+			return err
+		}
+		return withAutostash(w, autostash, verbose, func() error {
+			return gitext.FixUpstream(git, upstream, fixUpOpts)
+		})
 	}
 
 	if flag("up") {
-		fixUpstream(args["<branch>"].(string), verbose)
-		return
+		if _, err := gitext.RequireBranch(git); err != nil {
+			return err
+		}
+		branch, _ := args["<branch>"].(string)
+		if branch == "" {
+			branch = cfg.DefaultUpstream
+		}
+		if branch == "" && !stdinIsTerminal() {
+			return newUsageError("no branch given and no default_upstream configured")
+		}
+		if branch == "" {
+			var err error
+			if branch, err = selectUpstream(w, verbose); err != nil {
+				return err
+			}
+		}
+		if flag("--create") {
+			startPoint, _ := args["--from"].(string)
+			if err := ensureBranch(w, branch, startPoint, verbose); err != nil {
+				return err
+			}
+		}
+		if (!flag("--create") || !dryRun) && !flag("--latest") {
+			// A branch --create only pretended to make won't exist, and
+			// --latest may be about to fetch one.
+			if err := validateRef(git, branch); err != nil {
+				return err
+			}
+		}
+		fixUpOpts.Onto, _ = args["--onto"].(string)
+		fixUpOpts.FetchLatest = flag("--latest")
+		return withAutostash(w, autostash, verbose, func() error {
+			return gitext.FixUpstream(git, branch, fixUpOpts)
+		})
 	}
 
 	if flag("rup", "rec_fix_up") {
-		recFixUp(args["<terminal_branch>"].(string), verbose, []string{})
-		return
+		currBranch, err := gitext.RequireBranch(git)
+		if err != nil {
+			return err
+		}
+		if maxDepth, ok := args["--max-depth"].(string); ok {
+			if fixUpOpts.MaxChain, err = strconv.Atoi(maxDepth); err != nil || fixUpOpts.MaxChain < 1 {
+				return newUsageError("--max-depth must be a positive integer, got %q", maxDepth)
+			}
+		}
+		terminal := args["<terminal_branch>"].(string)
+		if err := validateRef(git, terminal); err != nil {
+			return err
+		}
+		return withAutostash(w, autostash, verbose, func() error {
+			fixUpOpts.Progress = func(step int, total int, branch string) {
+				printProgress(w, step, total, branch, verbose)
+			}
+			if verbose == verbosityVerbose {
+				fixUpOpts.Plan = func(chain []string, terminal string) {
+					printRecFixUpPlan(w, chain, terminal)
+				}
+			}
+			git := cliRunner{verbose.steps(), w}
+			return gitext.RecFixUp(git, currBranch, terminal, fixUpOpts)
+		})
 	}
 
 	if flag("cbr", "commit_br") {
-		commitBranch(args["<branch>"].(string), verbose)
-		return
+		message, _ := args["--message"].(string)
+		trailers, _ := args["--trailer"].([]string)
+		for _, trailer := range trailers {
+			if !strings.ContainsAny(trailer, "=:") {
+				return newUsageError("--trailer must look like key=value or \"key: value\", got %q", trailer)
+			}
+		}
+		branch, _ := args["<branch>"].(string)
+		if branch == "" {
+			var err error
+			if branch, err = promptBranchName(w); err != nil {
+				return err
+			}
+		}
+		if err := validateNewBranch(git, branch); err != nil {
+			return err
+		}
+		return withAutostash(w, autostash, verbose, func() error {
+			prefix, _ := args["--prefix"].(string)
+			return commitBranch(w, branch, message, prefix, trailers, flag("--track"), verbose)
+		})
+	}
+
+	if flag("amend") {
+		message, _ := args["--message"].(string)
+		return amendBranch(w, message, fixUpOpts, verbose)
+	}
+
+	if flag("fixup-commit", "fixup_commit") {
+		return gitext.FixupCommit(git, args["<ref>"].(string), gitext.FixupCommitOptions{
+			SquashNow:  flag("--squash-now"),
+			NoVerify:   noVerify,
+			Submodules: submodules,
+		})
 	}
 
 	if flag("po", "push_origin") {
-		pushOrigin(verbose)
-		return
+		return pushOrigin(w, verbose)
+	}
+
+	if flag("push-stack", "push_stack") {
+		return pushStack(w, verbose)
+	}
+
+	if flag("sync") {
+		return withAutostash(w, autostash, verbose, func() error {
+			return syncBranches(w, fixUpOpts, verbose)
+		})
+	}
+
+	if flag("rebase-stack", "rebase_stack") {
+		return withAutostash(w, autostash, verbose, func() error {
+			return rebaseStack(w, args["--onto"].(string), fixUpOpts, verbose)
+		})
+	}
+
+	if flag("completion") {
+		return printCompletion(w, args["<shell>"].(string))
+	}
+
+	if flag("undo") {
+		return gitext.Undo(git, submodules)
+	}
+
+	if flag("log-stack", "log_stack") {
+		return logStack(w, flag("--patch"))
+	}
+
+	if flag("status") {
+		return printStatus(w)
+	}
+
+	if flag("config") {
+		if flag("set") {
+			return setConfig(git, args["<key>"].(string), args["<value>"].(string))
+		}
+		return getConfig(w, git, args["<key>"].(string))
+	}
+
+	if flag("doctor") {
+		failures, err := printDoctorReport(w, runDoctorChecks(cliRunner{verbose, w}))
+		if err != nil {
+			return err
+		}
+		if failures > 0 {
+			return fmt.Errorf("doctor: %d check(s) failed", failures)
+		}
+		return nil
+	}
+
+	if flag("root-of") {
+		_, branchMap, err := gitext.BranchTree(git)
+		if err != nil {
+			return err
+		}
+		chain, err := gitext.ChainToRoot(branchMap, args["<branch>"].(string))
+		if err != nil {
+			return err
+		}
+		if flag("--chain") {
+			fmt.Fprintln(w, strings.Join(chain, " -> "))
+		} else {
+			fmt.Fprintln(w, chain[0])
+		}
+		return nil
+	}
+
+	if flag("workspace") {
+		if flag("save") {
+			return saveWorkspace(w, args["<name>"].(string), verbose)
+		}
+		if flag("checkout") {
+			return withAutostash(w, autostash, verbose, func() error {
+				return checkoutWorkspace(w, args["<name>"].(string), verbose)
+			})
+		}
+		return printWorkspaces(w)
+	}
+
+	if flag("export") {
+		return exportStack(w, resolvePath(args["<dir>"].(string)), verbose)
+	}
+
+	if flag("import") {
+		return importStack(w, resolvePath(args["<dir>"].(string)), flag("--3way"), verbose)
+	}
+
+	if flag("apply-stack") {
+		entries, err := readStackFile(resolvePath(args["<file>"].(string)))
+		if err != nil {
+			return err
+		}
+		if err := applyStack(w, entries, verbose); err != nil {
+			return err
+		}
+		if !flag("--sync") {
+			return nil
+		}
+		return withAutostash(w, autostash, verbose, func() error {
+			return syncBranches(w, fixUpOpts, verbose)
+		})
+	}
+
+	if flag("current", "cur") {
+		return printCurrent(w)
+	}
+
+	if flag("list") {
+		if flag("--all") {
+			infos, err := allBranchInfo(w)
+			if err != nil {
+				return err
+			}
+			return printBranchInfo(w, infos, flag("--json"), true)
+		}
+		info, err := currentBranchInfo(w, verbose)
+		if err != nil {
+			return err
+		}
+		return printBranchInfo(w, []branchInfo{info}, flag("--json"), false)
+	}
+
+	if flag("stashes") {
+		return printStashes(w, flag("--current"))
+	}
+
+	if flag("leaves", "branches") {
+		leaves, err := leafBranches(w)
+		if err != nil {
+			return err
+		}
+		return printLeaves(w, leaves, flag("--json"))
+	}
+
+	if flag("move") {
+		if _, err := gitext.RequireBranch(git); err != nil {
+			return err
+		}
+		return withAutostash(w, autostash, verbose, func() error {
+			return moveBranches(w, args["<branches>"].([]string), args["--onto"].(string), fixUpOpts, verbose)
+		})
+	}
+
+	if flag("rename") {
+		return renameBranch(w, args["<old>"].(string), args["<new>"].(string), verbose)
+	}
+
+	if flag("prune") {
+		return pruneBranches(w, assumeYes, verbose)
+	}
+
+	if flag("clean-merged", "clean_merged") {
+		return cleanMerged(w, args["--into"].(string), assumeYes, verbose)
 	}
 
 	if flag("tree", "show_tree") {
-		drawBranchTree()
-		return
+		opts := treeOptions{Format: "text", Remote: flag("--remote")}
+		opts.Pattern, _ = args["--pattern"].(string)
+		opts.Root, _ = args["--root"].(string)
+		opts.Sort, _ = args["--sort"].(string)
+		opts.Descriptions = flag("--descriptions")
+		opts.ShowDates = flag("--show-dates")
+		opts.ShowAuthors = flag("--show-authors")
+		opts.CollapseClean = flag("--collapse-clean")
+		if format, ok := args["--format"].(string); ok {
+			opts.Format = format
+		}
+		if flag("--json") {
+			opts.Format = "json"
+		}
+		if flag("--porcelain") {
+			opts.Format = "porcelain"
+		}
+		if text, ok := args["--template"].(string); ok {
+			if opts.Template, err = parseTreeTemplate(text); err != nil {
+				return err
+			}
+			opts.Format = "template"
+		}
+		if indent, ok := args["--indent"].(string); ok {
+			if indentAmount, err = strconv.Atoi(indent); err != nil || indentAmount < 0 {
+				return newUsageError("--indent must be a non-negative integer, got %q", indent)
+			}
+		} else if cfg.Indent != nil {
+			indentAmount = *cfg.Indent
+		}
+		abbrev := args["--abbrev"].(string)
+		if abbrevLength, err = strconv.Atoi(abbrev); err != nil || abbrevLength < 1 {
+			return newUsageError("--abbrev must be a positive integer, got %q", abbrev)
+		}
+		if depth, ok := args["--depth"].(string); ok {
+			if opts.MaxDepth, err = strconv.Atoi(depth); err != nil || opts.MaxDepth < 1 {
+				return newUsageError("--depth must be a positive integer, got %q", depth)
+			}
+		}
+		return drawBranchTree(w, opts)
+	}
+	return nil
+}
+
+// Exit codes, as documented in the usage.
+const (
+	exitError         = 1
+	exitUsage         = 2
+	exitDirtyTree     = 3
+	exitConflict      = 4
+	exitDetachedHead  = 5
+	exitUpstreamCycle = 6
+	exitInterrupted   = 130
+)
+
+// usageError is returned for invalid command line arguments.
+type usageError struct {
+	msg string
+}
+
+func newUsageError(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// exitCodeFor maps an error returned by a command to git_ext's exit code.
+func exitCodeFor(err error) int {
+	switch err.(type) {
+	case *usageError:
+		return exitUsage
+	case *gitext.DirtyTreeError, *gitext.OperationInProgressError:
+		return exitDirtyTree
+	case *gitext.ConflictError:
+		return exitConflict
+	case *gitext.UpstreamCycleError:
+		return exitUpstreamCycle
+	}
+	if err == gitext.ErrDetachedHead {
+		return exitDetachedHead
+	}
+	return exitError
+}
+
+// errorMessage is how main reports err, with color and a hint on what to do
+// next for the errors that have one.
+func errorMessage(err error) string {
+	switch err := err.(type) {
+	case *gitext.DirtyTreeError:
+		return colorize(err.Status, "white:red")
+	case *gitext.OperationInProgressError:
+		if err.Op == "cherry-pick" || err.Op == "rebase" {
+			return err.Error() + "\nIf git_ext's fix_up started it, use \"git_ext fu --continue\" or \"git_ext fu --abort\" instead."
+		}
+	case *gitext.VerifyError:
+		return colorize(err.Error(), "white:red") + "\nRun \"git_ext undo\" to put the branch back."
+	case *gitext.ConflictError:
+		if err.Aborted {
+			// git's hints about continuing no longer apply.
+			gitMsg := strings.SplitN(err.Err.Error(), "\n", 2)[0]
+			return gitMsg + "\n" + colorize(err.Op+" of "+err.Commit+" stopped with conflicts, so the branch was put back on its original commit.", "white:red")
+		}
+		return err.Err.Error() + "\n\n" + colorize(err.Op+" of "+err.Commit+" stopped with conflicts.", "white:red") + `
+Resolve them and run "git_ext fu --continue", or run "git_ext fu --abort"
+to put the branch back on its original commit.`
+	}
+	return err.Error()
+}
+
+func main() {
+	handleInterrupts(os.Stderr)
+	err := run(os.Stdout, os.Stderr)
+	if interrupted() {
+		fmt.Fprintln(os.Stderr, interruptMessage())
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		if msg := errorMessage(err); msg != "" {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		os.Exit(exitCodeFor(err))
 	}
 }
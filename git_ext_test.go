@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cjfuller/git_ext/gitext"
+	"github.com/cjfuller/git_ext/testutil"
+)
+
+func TestExitCodeFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("something broke"), exitError},
+		{&gitext.GitError{Args: []string{"status"}, ExitCode: 128}, exitError},
+		{newUsageError("bad flag"), exitUsage},
+		{errNotInRepo, exitUsage},
+		{&gitext.DirtyTreeError{Status: "M file"}, exitDirtyTree},
+		{&gitext.OperationInProgressError{Op: "rebase"}, exitDirtyTree},
+		{&gitext.ConflictError{Op: "cherry-pick", Commit: "1a2b3c4", Err: errors.New("conflict")}, exitConflict},
+		{gitext.ErrDetachedHead, exitDetachedHead},
+		{&gitext.UpstreamCycleError{Branches: []string{"a", "b", "a"}}, exitUpstreamCycle},
+	}
+	for _, test := range tests {
+		if got := exitCodeFor(test.err); got != test.want {
+			t.Errorf("exitCodeFor(%T %q) = %d, want %d", test.err, test.err, got, test.want)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a", "feat-b")
+
+	if result := repo.GitExt("tree"); result.ExitCode != 0 {
+		t.Errorf("tree exited %d, want 0", result.ExitCode)
+	}
+	if result := repo.GitExt("no-such-command"); result.ExitCode != exitUsage {
+		t.Errorf("an unknown command exited %d, want %d", result.ExitCode, exitUsage)
+	}
+
+	repo.Git("branch", "--set-upstream-to", "feat-b", "feat-a")
+	if result := repo.GitExt("rup", "-y", "main"); result.ExitCode != exitUpstreamCycle {
+		t.Errorf("rup through a cycle exited %d, want %d", result.ExitCode, exitUpstreamCycle)
+	}
+	repo.Git("branch", "--set-upstream-to", "main", "feat-a")
+
+	repo.Checkout("main")
+	repo.WriteFile("conflict.txt", "main\n")
+	repo.CommitAll("main's side")
+	repo.Checkout("feat-a")
+	repo.WriteFile("conflict.txt", "feat-a\n")
+	repo.CommitAll("feat-a's side")
+	if result := repo.GitExt("fu", "-y", "--on-conflict=keep"); result.ExitCode != exitConflict {
+		t.Errorf("fu with conflicts exited %d, want %d", result.ExitCode, exitConflict)
+	}
+	repo.MustGitExt("fu", "-y", "--abort")
+
+	repo.WriteFile("feat-a.txt", "changed\n")
+	if result := repo.GitExt("fu", "-y"); result.ExitCode != exitDirtyTree {
+		t.Errorf("fu with a dirty tree exited %d, want %d", result.ExitCode, exitDirtyTree)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a", "feat-b", "feat-c")
+	head := repo.Head()
+
+	result := repo.GitExt("rup", "-y", "--max-depth=2", "main")
+	if result.ExitCode != exitError || !strings.Contains(result.Stderr, "gave up after following 2 upstreams") {
+		t.Errorf("rup past --max-depth exited %d: %s", result.ExitCode, result.Stderr)
+	}
+	if repo.Head() != head {
+		t.Error("rup moved HEAD before giving up")
+	}
+	if result := repo.GitExt("rup", "-y", "--max-depth=0", "main"); result.ExitCode != exitUsage {
+		t.Errorf("rup --max-depth=0 exited %d, want %d", result.ExitCode, exitUsage)
+	}
+	repo.MustGitExt("rup", "-y", "--max-depth=3", "main")
+}
+
+func TestOperationInProgressBlocksFixUp(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a")
+	head := repo.Head()
+	repo.WriteFile(".git/MERGE_HEAD", repo.Sha("main")+"\n")
+	result := repo.GitExt("fu", "-y")
+	if result.ExitCode != exitDirtyTree {
+		t.Errorf("fu during a merge exited %d, want %d", result.ExitCode, exitDirtyTree)
+	}
+	if !strings.Contains(result.Stderr, "git merge is already in progress") {
+		t.Errorf("fu during a merge printed %q", result.Stderr)
+	}
+	if repo.Head() != head {
+		t.Error("fu moved HEAD during a merge")
+	}
+}
+
+func TestStatusClean(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a")
+	cleanColumn := func() string {
+		for _, line := range strings.Split(repo.MustGitExt("status"), "\n") {
+			if fields := strings.Fields(line); len(fields) > 4 && fields[0] == "feat-a" {
+				return fields[4]
+			}
+		}
+		t.Fatal("status doesn't list feat-a")
+		return ""
+	}
+	if got := cleanColumn(); got != "yes" {
+		t.Errorf("a clean tree is shown as %q", got)
+	}
+	repo.WriteFile("feat-a.txt", "changed\n")
+	if got := cleanColumn(); got != "no" {
+		t.Errorf("a modified tree is shown as %q", got)
+	}
+}
+
+func TestStrictClean(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a")
+	repo.WriteFile("notes.txt", "untracked\n")
+
+	result := repo.GitExt("--strict-clean", "fu", "-y")
+	if result.ExitCode != exitDirtyTree {
+		t.Errorf("fu --strict-clean with an untracked file exited %d, want %d", result.ExitCode, exitDirtyTree)
+	}
+	repo.MustGitExt("fu", "-y")
+	if !strings.Contains(repo.MustGitExt("status"), "untracked") {
+		t.Error("status doesn't show the untracked file")
+	}
+}
+
+// conflictingStack makes feat-a, tracking main, with a commit that conflicts
+// with one made on main since, and leaves feat-a checked out.
+func conflictingStack(repo *testutil.Repo) {
+	repo.Stack("main", "feat-a")
+	repo.WriteFile("conflict.txt", "feat-a\n")
+	repo.CommitAll("feat-a's side")
+	repo.Checkout("main")
+	repo.WriteFile("conflict.txt", "main\n")
+	repo.CommitAll("main's side")
+	repo.Checkout("feat-a")
+}
+
+func TestConflictAbortsByDefault(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	conflictingStack(repo)
+	head := repo.Head()
+
+	result := repo.GitExt("fu", "-y")
+	if result.ExitCode != exitConflict {
+		t.Errorf("fu with conflicts exited %d, want %d", result.ExitCode, exitConflict)
+	}
+	if got := repo.Head(); got != head {
+		t.Errorf("feat-a is at %s after the conflict, want its original %s", got, head)
+	}
+	if _, err := repo.Run([]string{"rev-parse", "--verify", "--quiet", "CHERRY_PICK_HEAD"}); err == nil {
+		t.Error("the cherry-pick is still in progress")
+	}
+	if out := repo.Git("status", "--porcelain"); out != "" {
+		t.Errorf("the working tree isn't clean after the abort:\n%s", out)
+	}
+}
+
+func TestConflictKeep(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	conflictingStack(repo)
+
+	if result := repo.GitExt("fu", "-y", "--on-conflict=keep"); result.ExitCode != exitConflict {
+		t.Errorf("fu --on-conflict=keep exited %d, want %d", result.ExitCode, exitConflict)
+	}
+	if _, err := repo.Run([]string{"rev-parse", "--verify", "--quiet", "CHERRY_PICK_HEAD"}); err != nil {
+		t.Error("--on-conflict=keep didn't leave the cherry-pick to resolve")
+	}
+}
+
+func TestCommitBranchDirtyLeavesNoBranch(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a")
+	repo.WriteFile("feat-a.txt", "changed\n")
+
+	if result := repo.GitExt("cbr", "-y", "split"); result.ExitCode != exitDirtyTree {
+		t.Errorf("cbr on a dirty tree exited %d, want %d", result.ExitCode, exitDirtyTree)
+	}
+	if repo.Git("branch", "--list", "split") != "" {
+		t.Error("cbr created the branch before finding the tree dirty")
+	}
+	repo.Git("checkout", "--", "feat-a.txt")
+	repo.MustGitExt("cbr", "-y", "split")
+}
+
+func TestCommitBranchMessage(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	shas := repo.Stack("main", "feat-a")
+	repo.Commit("extract me")
+
+	repo.MustGitExt("cbr", "-y", "-m", "Reworded", "split")
+	if got := repo.Git("log", "-1", "--format=%s", "split"); got != "Reworded" {
+		t.Errorf("split's commit says %q, want the reworded message", got)
+	}
+	if got := repo.Sha("feat-a"); got != shas[0] {
+		t.Errorf("feat-a is at %s, want its old HEAD~1 %s", got, shas[0])
+	}
+}
+
+func TestAutostashDryRun(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a")
+	head := repo.Head()
+	repo.WriteFile("feat-a.txt", "changed\n")
+
+	out := repo.MustGitExt("--dry-run", "--autostash", "fu")
+	for _, want := range []string{"git stash push", "git reset --hard main", "git stash pop"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the dry run doesn't show %q:\n%s", want, out)
+		}
+	}
+	if repo.Head() != head {
+		t.Error("the dry run moved HEAD")
+	}
+	if repo.Git("status", "--porcelain") == "" || repo.Git("stash", "list") != "" {
+		t.Error("the dry run stashed the changes")
+	}
+}
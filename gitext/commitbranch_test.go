@@ -0,0 +1,56 @@
+package gitext_test
+
+import (
+	"testing"
+
+	"github.com/cjfuller/git_ext/gitext"
+	"github.com/cjfuller/git_ext/testutil"
+)
+
+func TestCommitBranch(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	shas := repo.Stack("main", "feat-a")
+	extracted := repo.Commit("extract me")
+
+	opts := gitext.CommitBranchOptions{Message: "Reworded", Track: true}
+	if err := gitext.CommitBranch(repo, "split", opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.Git("rev-parse", "--abbrev-ref", "HEAD"); got != "split" {
+		t.Errorf("%s is checked out, want split", got)
+	}
+	if got := repo.Git("log", "-1", "--format=%s", "split"); got != "Reworded" {
+		t.Errorf("split's commit says %q, want the reworded message", got)
+	}
+	if got := repo.Sha("split~1"); got != shas[0] {
+		t.Errorf("split's commit is on %s, want feat-a's old HEAD~1 %s", got, shas[0])
+	}
+	if got, want := repo.Git("log", "-1", "--format=%an %ad", "split"), repo.Git("log", "-1", "--format=%an %ad", extracted); got != want {
+		t.Errorf("the reworded commit's author is %q, want %q", got, want)
+	}
+	if got := repo.Sha("feat-a"); got != shas[0] {
+		t.Errorf("feat-a is at %s, want its old HEAD~1 %s", got, shas[0])
+	}
+	if got := repo.Git("rev-parse", "--abbrev-ref", "split@{u}"); got != "feat-a" {
+		t.Errorf("split tracks %s, want feat-a", got)
+	}
+}
+
+func TestCommitBranchEmpty(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.Stack("main", "feat-a")
+	head := repo.CommitAll("nothing in it")
+
+	err := gitext.CommitBranch(repo, "split", gitext.CommitBranchOptions{Message: "Reworded"})
+	if err != gitext.ErrEmptyCommit {
+		t.Errorf("CommitBranch on an empty commit returned %v, want ErrEmptyCommit", err)
+	}
+	if repo.Git("branch", "--list", "split") != "" {
+		t.Error("CommitBranch created the branch for an empty commit")
+	}
+	if repo.Head() != head {
+		t.Error("CommitBranch moved HEAD")
+	}
+}
@@ -0,0 +1,31 @@
+package gitext_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cjfuller/git_ext/gitext"
+	"github.com/cjfuller/git_ext/testutil"
+)
+
+func TestExecRunnerGitError(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	args := []string{"rev-parse", "--verify", "no-such-ref"}
+	_, err := gitext.ExecRunner{Dir: repo.Dir}.RunWithEnv(repo.Env(), args)
+	var gitErr *gitext.GitError
+	if !errors.As(err, &gitErr) {
+		t.Fatalf("a failing command returned %v, want a *GitError", err)
+	}
+	if !reflect.DeepEqual(gitErr.Args, args) {
+		t.Errorf("Args = %v, want %v", gitErr.Args, args)
+	}
+	if !strings.Contains(gitErr.Stderr, "fatal: Needed a single revision") {
+		t.Errorf("Stderr = %q, want git's error message", gitErr.Stderr)
+	}
+	if gitErr.ExitCode != 128 {
+		t.Errorf("ExitCode = %d, want 128", gitErr.ExitCode)
+	}
+}
@@ -0,0 +1,687 @@
+package gitext
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FixUpOptions tweaks how FixUpstream moves a branch onto its upstream.
+type FixUpOptions struct {
+	// LastOnly carries over just the branch's last commit rather than every
+	// commit it has beyond its upstream.
+	LastOnly bool
+	// Fetch updates the upstream's remote, if it has one, before resetting.
+	Fetch bool
+	// FetchLatest fetches just the upstream's branch from its remote before
+	// resetting, failing if the upstream isn't a remote-tracking branch.
+	FetchLatest bool
+	// Rebase replays the branch onto the upstream with `git rebase --onto`
+	// instead of resetting and cherry-picking.
+	Rebase bool
+	// Onto, if set, is the commit to put the branch's commits on top of in
+	// place of the upstream's tip.
+	Onto string
+	// MaxChain limits how many upstreams RecFixUp follows to find the
+	// terminal branch; 0 means DefaultMaxChain.
+	MaxChain int
+	// OnConflict is what to do when replaying the branch's commits stops with
+	// conflicts: "abort" (or "") puts the branch back where it was and
+	// returns a *ConflictError with Aborted set; "keep" leaves them to be
+	// resolved and returns one without. "ours" and "theirs" pass -X ours or -X theirs to
+	// git, so conflicting hunks take the upstream's or the branch's side;
+	// those are merge strategy options, so conflicts they can't settle, like
+	// a file deleted on one side, still stop as with "keep".
+	OnConflict string
+	// Verify checks the branch once it's fixed up: that it's built on the
+	// upstream and that each carried commit makes the same changes it did
+	// before. A mismatch is returned as a *VerifyError.
+	Verify bool
+	// Submodules controls how submodules follow each change of HEAD.
+	Submodules SubmoduleOptions
+	// ConfirmReset, if set, is asked before the branch is reset to target,
+	// leaving head behind. Returning an error stops the fix-up.
+	ConfirmReset func(target string, head string) error
+	// Progress, if set, is called before RecFixUp fixes up each of total
+	// branches.
+	Progress func(step int, total int, branch string)
+	// Plan, if set, is called with the branches RecFixUp will fix up,
+	// nearest terminal first, before it starts.
+	Plan func(chain []string, terminal string)
+}
+
+// strategyArgs are the arguments that apply OnConflict to a cherry-pick or
+// rebase.
+func (opts FixUpOptions) strategyArgs() []string {
+	if opts.OnConflict == "ours" || opts.OnConflict == "theirs" {
+		return []string{"-X", opts.OnConflict}
+	}
+	return nil
+}
+
+// conflictError is rebaseError or cherryPickError, as given, followed by an
+// abort if OnConflict asks for one. Aborting also points branch back at
+// oldUpstream.
+func (opts FixUpOptions) conflictError(r Runner, err error, branch string, oldUpstream string) error {
+	conflict, ok := err.(*ConflictError)
+	if !ok || (opts.OnConflict != "" && opts.OnConflict != "abort") {
+		return err
+	}
+	if abortErr := AbortFixUp(r, opts.Submodules); abortErr != nil {
+		return fmt.Errorf("%v\nunable to abort: %v", err, abortErr)
+	}
+	if setErr := SetUpstream(r, branch, oldUpstream); setErr != nil {
+		return fmt.Errorf("%v\nunable to restore the upstream: %v", err, setErr)
+	}
+	conflict.Aborted = true
+	return conflict
+}
+
+// SetUpstream sets branch's upstream, or removes it if upstream is "".
+func SetUpstream(r Runner, branch string, upstream string) error {
+	if upstream == "" {
+		_, err := run(r, "branch", "--unset-upstream", branch)
+		return err
+	}
+	_, err := run(r, "branch", "--set-upstream-to", upstream, branch)
+	return err
+}
+
+// UpstreamOrNone returns branch's upstream, or "" if it doesn't have one.
+func UpstreamOrNone(r Runner, branch string) (string, error) {
+	upstream, err := UpstreamOf(r, branch)
+	if isGitError(err) {
+		return "", nil
+	}
+	return upstream, err
+}
+
+func (opts FixUpOptions) confirmReset(target string, head string) error {
+	if opts.ConfirmReset == nil {
+		return nil
+	}
+	return opts.ConfirmReset(target, head)
+}
+
+// origHeadRefPrefix namespaces the refs recording where each branch was
+// before FixUpstream reset it, so that a conflicted fix-up can be aborted.
+// Each is deleted once its fix-up finishes or is aborted.
+const origHeadRefPrefix = "refs/git_ext/orig-heads/"
+
+func origHeadRef(branch string) string {
+	return origHeadRefPrefix + branch
+}
+
+// clearOrigHead deletes branch's recorded head, if it has one.
+func clearOrigHead(r Runner, branch string) error {
+	_, err := run(r, "update-ref", "-d", origHeadRef(branch))
+	return err
+}
+
+// fixUpBranch returns the branch a stopped cherry-pick or rebase is on. A
+// rebase detaches HEAD, so its branch comes from the rebase's own state.
+func fixUpBranch(r Runner, rebasing bool) (string, error) {
+	if !rebasing {
+		return RequireBranch(r)
+	}
+	for _, dir := range []string{"rebase-merge", "rebase-apply"} {
+		path, err := gitPath(r, filepath.Join(dir, "head-name"))
+		if err != nil {
+			return "", err
+		}
+		if headName, err := ioutil.ReadFile(path); err == nil {
+			return strings.TrimPrefix(strings.TrimSpace(string(headName)), "refs/heads/"), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", ErrDetachedHead
+}
+
+// branchCommits lists the commits on HEAD that aren't on upstream, oldest
+// first. If upstream has been rewritten since the branch was made, the fork
+// point from upstream's reflog is used so the branch's copies of the old
+// upstream commits are left behind; commits whose patches are already on
+// upstream are skipped too.
+func branchCommits(r Runner, upstream string) ([]string, error) {
+	cmdargs := []string{"rev-list", "--reverse", "--no-merges", "--right-only", "--cherry-pick", upstream + "...HEAD"}
+	forkPoint, err := run(r, "merge-base", "--fork-point", upstream, "HEAD")
+	if err == nil {
+		cmdargs = append(cmdargs, "^"+forkPoint)
+	} else if !isGitError(err) {
+		return nil, err
+	}
+	commits, err := run(r, append(cmdargs, "--")...)
+	if err != nil || commits == "" {
+		return nil, err
+	}
+	return strings.Split(commits, "\n"), nil
+}
+
+// FetchBranch updates the remote-tracking branch upstream, e.g. origin/main,
+// by fetching just that branch from its remote.
+func FetchBranch(r Runner, upstream string) error {
+	remote, err := RemoteOf(r, upstream)
+	if err != nil {
+		return err
+	}
+	if remote == "" {
+		return fmt.Errorf("%s isn't a remote-tracking branch, so there's nothing to fetch", upstream)
+	}
+	// Naming the remote-tracking ref updates it even for remotes whose
+	// fetch refspecs don't cover the branch.
+	branch := strings.TrimPrefix(upstream, remote+"/")
+	_, err = run(r, "fetch", remote, "+refs/heads/"+branch+":refs/remotes/"+remote+"/"+branch)
+	return err
+}
+
+// FixUpstream sets the current branch's upstream to upstream, resets the
+// branch to it, and cherry-picks the branch's own commits back on top. If
+// that stops with conflicts, it returns a *ConflictError and the fix-up can
+// be finished with ContinueFixUp or undone with AbortFixUp.
+func FixUpstream(r Runner, upstream string, opts FixUpOptions) error {
+	if err := EnsureNoOperationInProgress(r); err != nil {
+		return err
+	}
+	if opts.FetchLatest {
+		if err := FetchBranch(r, upstream); err != nil {
+			return err
+		}
+	} else if opts.Fetch {
+		remote, err := RemoteOf(r, upstream)
+		if err != nil {
+			return err
+		}
+		if remote != "" {
+			if _, err := run(r, "fetch", remote); err != nil {
+				return err
+			}
+		}
+	}
+	target := upstream
+	if opts.Onto != "" {
+		exists, err := RefExists(r, opts.Onto+"^{commit}")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s doesn't resolve to a commit", opts.Onto)
+		}
+		target = opts.Onto
+	}
+	if opts.Rebase {
+		return rebaseOntoUpstream(r, upstream, target, opts)
+	}
+	branch, err := RequireBranch(r)
+	if err != nil {
+		return err
+	}
+	origHead, err := LastHash(r, "%H")
+	if err != nil {
+		return err
+	}
+	commits := []string{origHead}
+	if !opts.LastOnly {
+		if commits, err = branchCommits(r, upstream); err != nil {
+			return err
+		}
+	}
+	if err := opts.confirmReset(target, origHead); err != nil {
+		return err
+	}
+	oldUpstream, err := UpstreamOrNone(r, branch)
+	if err != nil {
+		return err
+	}
+	if _, err := run(r, "branch", "--set-upstream-to", upstream); err != nil {
+		return err
+	}
+	if err := EnsureClean(r); err != nil {
+		return err
+	}
+	if _, err := run(r, "update-ref", origHeadRef(branch), origHead); err != nil {
+		return err
+	}
+	if err := SaveUndoPoint(r, "fix_up"); err != nil {
+		return err
+	}
+	if _, err := run(r, "reset", "--hard", target, "--"); err != nil {
+		return err
+	}
+	if err := UpdateSubmodules(r, opts.Submodules); err != nil {
+		return err
+	}
+	if len(commits) > 0 {
+		cmdargs := append([]string{"cherry-pick"}, opts.strategyArgs()...)
+		if _, err := run(r, append(cmdargs, commits...)...); err != nil {
+			return opts.conflictError(r, cherryPickError(r, err), branch, oldUpstream)
+		}
+	}
+	if err := clearOrigHead(r, branch); err != nil {
+		return err
+	}
+	if len(commits) > 0 {
+		if err := UpdateSubmodules(r, opts.Submodules); err != nil {
+			return err
+		}
+	}
+	if opts.Verify {
+		return verifyFixUp(r, target, commits)
+	}
+	return nil
+}
+
+// oldUpstreamBase returns the commit the branch's own commits start after:
+// where it forked from upstream, or HEAD~1 if lastOnly is set.
+func oldUpstreamBase(r Runner, upstream string, lastOnly bool) (string, error) {
+	if lastOnly {
+		return run(r, "rev-parse", "HEAD~1")
+	}
+	forkPoint, err := run(r, "merge-base", "--fork-point", upstream, "HEAD")
+	if err == nil {
+		return forkPoint, nil
+	} else if !isGitError(err) {
+		return "", err
+	}
+	return run(r, "merge-base", upstream, "HEAD")
+}
+
+// rebaseOntoUpstream is FixUpstream's Rebase mode: it replays the branch's
+// commits since its old base on upstream onto target.
+func rebaseOntoUpstream(r Runner, upstream string, target string, opts FixUpOptions) error {
+	branch, err := RequireBranch(r)
+	if err != nil {
+		return err
+	}
+	origHead, err := LastHash(r, "%H")
+	if err != nil {
+		return err
+	}
+	base, err := oldUpstreamBase(r, upstream, opts.LastOnly)
+	if err != nil {
+		return err
+	}
+	oldUpstream, err := UpstreamOrNone(r, branch)
+	if err != nil {
+		return err
+	}
+	if _, err := run(r, "branch", "--set-upstream-to", upstream); err != nil {
+		return err
+	}
+	if err := EnsureClean(r); err != nil {
+		return err
+	}
+	if _, err := run(r, "update-ref", origHeadRef(branch), origHead); err != nil {
+		return err
+	}
+	if err := SaveUndoPoint(r, "fix_up"); err != nil {
+		return err
+	}
+	cmdargs := append([]string{"rebase"}, opts.strategyArgs()...)
+	if _, err := run(r, append(cmdargs, "--onto", target, base, branch)...); err != nil {
+		return opts.conflictError(r, rebaseError(r, err), branch, oldUpstream)
+	}
+	if err := clearOrigHead(r, branch); err != nil {
+		return err
+	}
+	if err := UpdateSubmodules(r, opts.Submodules); err != nil {
+		return err
+	}
+	if opts.Verify {
+		// The rebase may drop commits that are already on target, so only
+		// the ancestry can be checked.
+		return verifyFixUp(r, target, nil)
+	}
+	return nil
+}
+
+// RebaseInProgress reports whether a rebase has stopped partway.
+func RebaseInProgress(r Runner) (bool, error) {
+	for _, dir := range []string{"rebase-merge", "rebase-apply"} {
+		if exists, err := gitPathExists(r, dir); err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// CherryPickInProgress reports whether a cherry-pick has stopped partway.
+func CherryPickInProgress(r Runner) (bool, error) {
+	return gitPathExists(r, "CHERRY_PICK_HEAD")
+}
+
+// rebaseError turns a failed rebase into a *ConflictError if it stopped
+// partway with conflicts.
+func rebaseError(r Runner, err error) error {
+	if inProgress, checkErr := RebaseInProgress(r); checkErr != nil || !inProgress {
+		return err
+	}
+	commit, checkErr := run(r, "rev-parse", "REBASE_HEAD")
+	if checkErr != nil {
+		return err
+	}
+	return &ConflictError{Op: "rebase", Commit: commit, Err: err}
+}
+
+// cherryPickError turns a failed cherry-pick into a *ConflictError if it
+// stopped partway with conflicts.
+func cherryPickError(r Runner, err error) error {
+	if inProgress, checkErr := CherryPickInProgress(r); checkErr != nil || !inProgress {
+		return err
+	}
+	commit, checkErr := run(r, "rev-parse", "CHERRY_PICK_HEAD")
+	if checkErr != nil {
+		return err
+	}
+	return &ConflictError{Op: "cherry-pick", Commit: commit, Err: err}
+}
+
+// ConflictError is returned when replaying a branch's commits onto its
+// upstream stops with conflicts.
+type ConflictError struct {
+	// Op is the git command that stopped: cherry-pick or rebase.
+	Op     string
+	Commit string
+	Err    error
+	// Aborted is set when the fix-up was undone rather than left stopped.
+	Aborted bool
+}
+
+func (e *ConflictError) Error() string {
+	msg := e.Err.Error() + "\n\n" + e.Op + " of " + e.Commit + " stopped with conflicts"
+	if e.Aborted {
+		return msg + ", so the branch was put back on its original commit."
+	}
+	return msg + "."
+}
+
+// ErrNoFixUpInProgress is returned by ContinueFixUp and AbortFixUp when
+// there's nothing to continue or abort.
+var ErrNoFixUpInProgress = errors.New("there's no fix_up cherry-pick or rebase in progress")
+
+// ContinueFixUp finishes a fix-up whose cherry-pick or rebase stopped with
+// conflicts, once they've been resolved.
+func ContinueFixUp(r Runner, submodules SubmoduleOptions) error {
+	inProgress, err := CherryPickInProgress(r)
+	if err != nil {
+		return err
+	}
+	if !inProgress {
+		rebasing, err := RebaseInProgress(r)
+		if err != nil {
+			return err
+		}
+		if !rebasing {
+			return ErrNoFixUpInProgress
+		}
+		branch, err := fixUpBranch(r, true)
+		if err != nil {
+			return err
+		}
+		if _, err := run(r, "-c", "core.editor=true", "rebase", "--continue"); err != nil {
+			return rebaseError(r, err)
+		}
+		if err := clearOrigHead(r, branch); err != nil {
+			return err
+		}
+		return UpdateSubmodules(r, submodules)
+	}
+	branch, err := fixUpBranch(r, false)
+	if err != nil {
+		return err
+	}
+	// Keep the original commit message rather than opening an editor.
+	if _, err := run(r, "-c", "core.editor=true", "cherry-pick", "--continue"); err != nil {
+		return cherryPickError(r, err)
+	}
+	if err := clearOrigHead(r, branch); err != nil {
+		return err
+	}
+	return UpdateSubmodules(r, submodules)
+}
+
+// AbortFixUp abandons a conflicted fix-up and resets the branch to where it
+// was before it started. A cherry-pick or rebase that FixUpstream didn't
+// start on the checked-out branch is left alone, and ErrNoFixUpInProgress
+// returned.
+func AbortFixUp(r Runner, submodules SubmoduleOptions) error {
+	picking, err := CherryPickInProgress(r)
+	if err != nil {
+		return err
+	}
+	rebasing := false
+	if !picking {
+		if rebasing, err = RebaseInProgress(r); err != nil {
+			return err
+		}
+		if !rebasing {
+			return ErrNoFixUpInProgress
+		}
+	}
+	branch, err := fixUpBranch(r, rebasing)
+	if err == ErrDetachedHead {
+		return ErrNoFixUpInProgress
+	} else if err != nil {
+		return err
+	}
+	// Only a fix-up FixUpstream started has a recorded head to go back to;
+	// resetting anyone else's would lose the branch.
+	commit, err := run(r, "rev-parse", "--verify", "--quiet", origHeadRef(branch))
+	if isGitError(err) {
+		return ErrNoFixUpInProgress
+	} else if err != nil {
+		return err
+	}
+	if rebasing {
+		// rebase --abort puts the branch back on its original commit itself.
+		if _, err := run(r, "rebase", "--abort"); err != nil {
+			return err
+		}
+	} else {
+		if _, err := run(r, "cherry-pick", "--abort"); err != nil {
+			return err
+		}
+		if _, err := run(r, "reset", "--hard", commit, "--"); err != nil {
+			return err
+		}
+	}
+	if err := clearOrigHead(r, branch); err != nil {
+		return err
+	}
+	return UpdateSubmodules(r, submodules)
+}
+
+// UpstreamCycleError is returned when following upstreams leads back to a
+// branch that's already been visited.
+type UpstreamCycleError struct {
+	Branches []string
+}
+
+// newUpstreamCycleError builds the error for a walk that has reached start
+// again. chain holds the branches visited so far, most recent first.
+func newUpstreamCycleError(start string, chain []string) *UpstreamCycleError {
+	cycle := []string{start}
+	for i := 0; i < len(chain) && chain[i] != start; i++ {
+		cycle = append([]string{chain[i]}, cycle...)
+	}
+	return &UpstreamCycleError{Branches: append([]string{start}, cycle...)}
+}
+
+func (e *UpstreamCycleError) Error() string {
+	return "upstream cycle detected: " + strings.Join(e.Branches, " -> ")
+}
+
+// DefaultMaxChain is how many upstreams RecFixUp follows before giving up,
+// unless FixUpOptions.MaxChain says otherwise.
+const DefaultMaxChain = 100
+
+// UpstreamChain walks upstreams by name from branch until it reaches
+// terminal, returning the branches on the way, nearest to terminal first.
+// Walking by name rather than by checking out each upstream means nothing is
+// modified. It gives up after maxChain upstreams, or DefaultMaxChain if
+// maxChain isn't positive.
+func UpstreamChain(r Runner, branch string, terminal string, maxChain int) ([]string, error) {
+	if maxChain <= 0 {
+		maxChain = DefaultMaxChain
+	}
+	chain := []string{}
+	visited := map[string]bool{}
+	for branch != terminal {
+		if len(chain) >= maxChain {
+			return nil, fmt.Errorf("gave up after following %d upstreams from %s without reaching %s", maxChain, chain[len(chain)-1], terminal)
+		}
+		visited[branch] = true
+		upstream, err := UpstreamOf(r, branch)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]string{branch}, chain...)
+		if visited[upstream] {
+			return nil, newUpstreamCycleError(upstream, chain)
+		}
+		branch = upstream
+	}
+	return chain, nil
+}
+
+// RecFixUp finds the chain of upstreams from currBranch to terminal, then
+// checks out and fixes up each branch on it, starting nearest terminal.
+func RecFixUp(r Runner, currBranch string, terminal string, opts FixUpOptions) error {
+	chain, err := UpstreamChain(r, currBranch, terminal, opts.MaxChain)
+	if err != nil {
+		return err
+	}
+	if opts.Plan != nil {
+		opts.Plan(chain, terminal)
+	}
+	for i, branch := range chain {
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(chain), branch)
+		}
+		if err := Checkout(r, branch, opts.Submodules); err != nil {
+			return err
+		}
+		upstream, err := UpstreamOf(r, branch)
+		if err != nil {
+			return err
+		}
+		if err := FixUpstream(r, upstream, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CommitBranchOptions tweaks how CommitBranch extracts the last commit.
+type CommitBranchOptions struct {
+	// Message, if set, rewords the extracted commit.
+	Message string
+	// Prefix, if set, is put in front of the extracted commit's message (or
+	// Message), separated by a space.
+	Prefix string
+	// Trailers are added to the extracted commit's message with
+	// `git commit --trailer`, each as "key=value" or "key: value".
+	Trailers []string
+	// Track sets the new branch's upstream to the branch it was extracted
+	// from. It's ignored when HEAD is detached.
+	Track bool
+	// Submodules controls how submodules follow each change of HEAD.
+	Submodules SubmoduleOptions
+	// ConfirmReset is asked before the current branch is reset to HEAD~1,
+	// as for FixUpOptions.
+	ConfirmReset func(target string, head string) error
+	// NoVerify skips the pre-commit and commit-msg hooks when rewording.
+	NoVerify bool
+}
+
+// ErrEmptyCommit is returned by CommitBranch when rewording a commit that has
+// no changes.
+var ErrEmptyCommit = errors.New("the commit to extract has no changes; refusing to create an empty commit")
+
+// CommitBranchMessage is the message CommitBranch will reword the extracted
+// commit to, or "" if it's left alone.
+func CommitBranchMessage(r Runner, opts CommitBranchOptions) (string, error) {
+	if opts.Prefix == "" {
+		return opts.Message, nil
+	}
+	message := opts.Message
+	if message == "" {
+		var err error
+		if message, err = LastHash(r, "%B"); err != nil {
+			return "", err
+		}
+	}
+	return opts.Prefix + " " + message, nil
+}
+
+// CommitBranch moves the last commit onto a new branch named name, leaving
+// the current branch at HEAD~1 and checking out the new branch. Rewording
+// keeps the commit's author and author date.
+func CommitBranch(r Runner, name string, opts CommitBranchOptions) error {
+	// Check everything before creating the branch, so that a failed check
+	// leaves nothing behind.
+	if err := EnsureClean(r); err != nil {
+		return err
+	}
+	message, err := CommitBranchMessage(r, opts)
+	if err != nil {
+		return err
+	}
+	reword := message != "" || len(opts.Trailers) > 0
+	if reword {
+		_, err := run(r, "diff", "--quiet", "HEAD~1", "HEAD", "--")
+		if err == nil {
+			return ErrEmptyCommit
+		} else if gitErr, ok := err.(*GitError); !ok || gitErr.ExitCode != 1 {
+			return err
+		}
+	}
+	head, err := LastHash(r, "%H")
+	if err != nil {
+		return err
+	}
+	if opts.ConfirmReset != nil {
+		if err := opts.ConfirmReset("HEAD~1", head); err != nil {
+			return err
+		}
+	}
+	if _, err := run(r, "branch", name); err != nil {
+		return err
+	}
+	if opts.Track {
+		origBranch, detached, err := CurrentBranch(r)
+		if err != nil {
+			return err
+		}
+		if !detached {
+			if _, err := run(r, "branch", "--set-upstream-to", origBranch, name); err != nil {
+				return err
+			}
+		}
+	}
+	if err := SaveUndoPoint(r, "commit_br"); err != nil {
+		return err
+	}
+	if _, err := run(r, "reset", "--hard", "HEAD~1"); err != nil {
+		return err
+	}
+	if _, err := run(r, "checkout", name); err != nil {
+		return err
+	}
+	if reword {
+		cmdargs := []string{"--amend", "--no-edit"}
+		if message != "" {
+			cmdargs = []string{"--amend", "-m", message}
+		}
+		for _, trailer := range opts.Trailers {
+			cmdargs = append(cmdargs, "--trailer", trailer)
+		}
+		if _, err := run(r, commitArgs(opts.NoVerify, cmdargs...)...); err != nil {
+			return err
+		}
+	}
+	return UpdateSubmodules(r, opts.Submodules)
+}
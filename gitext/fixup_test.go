@@ -0,0 +1,134 @@
+package gitext
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// upstreamOutputs is canned output for UpstreamOf, from each branch to its
+// upstream.
+func upstreamOutputs(upstreams map[string]string) map[string]string {
+	outputs := map[string]string{}
+	for branch, upstream := range upstreams {
+		outputs["rev-parse --abbrev-ref --symbolic-full-name "+branch+"@{u}"] = upstream
+	}
+	return outputs
+}
+
+func TestUpstreamChain(t *testing.T) {
+	f := &fakeRunner{outputs: upstreamOutputs(map[string]string{
+		"c": "b",
+		"b": "a",
+		"a": "origin/main",
+	})}
+	chain, err := UpstreamChain(f, "c", "origin/main", DefaultMaxChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(chain, want) {
+		t.Errorf("UpstreamChain returned %v, want %v", chain, want)
+	}
+}
+
+func TestRecFixUpCycle(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams map[string]string
+		start     string
+		want      []string
+	}{
+		{
+			name:      "two branches",
+			upstreams: map[string]string{"a": "b", "b": "a"},
+			start:     "a",
+			want:      []string{"a", "b", "a"},
+		},
+		{
+			name:      "own upstream",
+			upstreams: map[string]string{"a": "a"},
+			start:     "a",
+			want:      []string{"a", "a"},
+		},
+		{
+			name:      "cycle above the start",
+			upstreams: map[string]string{"c": "b", "b": "a", "a": "b"},
+			start:     "c",
+			want:      []string{"b", "a", "b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &fakeRunner{outputs: upstreamOutputs(test.upstreams)}
+			err := RecFixUp(f, test.start, "origin/main", FixUpOptions{})
+			cycleErr, ok := err.(*UpstreamCycleError)
+			if !ok {
+				t.Fatalf("RecFixUp returned %v, want an *UpstreamCycleError", err)
+			}
+			if !reflect.DeepEqual(cycleErr.Branches, test.want) {
+				t.Errorf("cycle is %v, want %v", cycleErr.Branches, test.want)
+			}
+			if f.ran("checkout") || f.ran("reset") {
+				t.Errorf("RecFixUp changed branches before finding the cycle: %v", f.calls)
+			}
+		})
+	}
+}
+
+func TestRecFixUpMaxChain(t *testing.T) {
+	f := &fakeRunner{outputs: upstreamOutputs(map[string]string{
+		"c": "b",
+		"b": "a",
+		"a": "origin/main",
+	})}
+	err := RecFixUp(f, "c", "origin/main", FixUpOptions{MaxChain: 2})
+	if err == nil {
+		t.Fatal("RecFixUp followed a chain longer than MaxChain")
+	}
+	if f.ran("checkout") {
+		t.Errorf("RecFixUp changed branches before checking the chain: %v", f.calls)
+	}
+}
+
+// longChain is canned upstreams for a chain of n branches, b1 tracking
+// origin/main and each after tracking the one before, up to bn.
+func longChain(n int) map[string]string {
+	upstreams := map[string]string{"b1": "origin/main"}
+	for i := 2; i <= n; i++ {
+		upstreams[fmt.Sprintf("b%d", i)] = fmt.Sprintf("b%d", i-1)
+	}
+	return upstreamOutputs(upstreams)
+}
+
+func TestUpstreamChainLong(t *testing.T) {
+	f := &fakeRunner{outputs: longChain(DefaultMaxChain)}
+	chain, err := UpstreamChain(f, fmt.Sprintf("b%d", DefaultMaxChain), "origin/main", DefaultMaxChain)
+	if err != nil {
+		t.Fatalf("a chain of exactly %d: %v", DefaultMaxChain, err)
+	}
+	if len(chain) != DefaultMaxChain || chain[0] != "b1" {
+		t.Errorf("chain has %d branches starting at %s", len(chain), chain[0])
+	}
+
+	f = &fakeRunner{outputs: longChain(5000)}
+	err = RecFixUp(f, "b5000", "origin/main", FixUpOptions{})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("gave up after following %d upstreams", DefaultMaxChain)) {
+		t.Fatalf("RecFixUp on a chain of 5000 returned %v", err)
+	}
+	if len(f.calls) > DefaultMaxChain+1 {
+		t.Errorf("RecFixUp ran %d git commands before giving up", len(f.calls))
+	}
+}
+
+func TestUpstreamChainNoLimit(t *testing.T) {
+	for _, maxChain := range []int{0, -1} {
+		f := &fakeRunner{outputs: longChain(3)}
+		chain, err := UpstreamChain(f, "b3", "origin/main", maxChain)
+		if err != nil {
+			t.Errorf("with maxChain %d: %v", maxChain, err)
+		} else if len(chain) != 3 {
+			t.Errorf("with maxChain %d, the chain is %v", maxChain, chain)
+		}
+	}
+}
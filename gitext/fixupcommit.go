@@ -0,0 +1,111 @@
+package gitext
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FixupCommitOptions tweaks how FixupCommit records its fix.
+type FixupCommitOptions struct {
+	// SquashNow immediately folds the fixup! commit into its target with a
+	// non-interactive `git rebase -i --autosquash`.
+	SquashNow bool
+	// NoVerify skips the pre-commit and commit-msg hooks.
+	NoVerify   bool
+	Submodules SubmoduleOptions
+}
+
+// commitArgs is `git commit` with args, and with --no-verify if noVerify is
+// set.
+func commitArgs(noVerify bool, args ...string) []string {
+	cmdargs := []string{"commit"}
+	if noVerify {
+		cmdargs = append(cmdargs, "--no-verify")
+	}
+	return append(cmdargs, args...)
+}
+
+// ErrNothingStaged is returned by FixupCommit when there are no staged
+// changes to commit.
+var ErrNothingStaged = errors.New("there are no staged changes to make a fixup commit from")
+
+// ErrUnstagedChanges is returned when an operation that rewrites the branch
+// would have to carry unstaged changes along.
+var ErrUnstagedChanges = errors.New("there are unstaged changes; stage the ones to amend (or stash the rest) first")
+
+// diffQuiet reports whether `git diff --quiet` with args finds no changes.
+func diffQuiet(r Runner, args ...string) (bool, error) {
+	_, err := run(r, append([]string{"diff", "--quiet"}, args...)...)
+	if err == nil {
+		return true, nil
+	} else if gitErr, ok := err.(*GitError); ok && gitErr.ExitCode == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// IsAncestor reports whether ancestor is reachable from commit.
+func IsAncestor(r Runner, ancestor string, commit string) (bool, error) {
+	_, err := run(r, "merge-base", "--is-ancestor", ancestor, commit)
+	if err == nil {
+		return true, nil
+	} else if gitErr, ok := err.(*GitError); ok && gitErr.ExitCode == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// FixupCommit commits the staged changes as a `fixup!` of ref, which must be
+// an ancestor of HEAD. With SquashNow, the fixup is then squashed into ref
+// right away; if that stops with conflicts, it returns a *ConflictError.
+func FixupCommit(r Runner, ref string, opts FixupCommitOptions) error {
+	if err := EnsureNoOperationInProgress(r); err != nil {
+		return err
+	}
+	if exists, err := RefExists(r, ref+"^{commit}"); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("%s doesn't resolve to a commit", ref)
+	}
+	if ancestor, err := IsAncestor(r, ref, "HEAD"); err != nil {
+		return err
+	} else if !ancestor {
+		return fmt.Errorf("%s isn't an ancestor of HEAD", ref)
+	}
+	if nothingStaged, err := diffQuiet(r, "--cached"); err != nil {
+		return err
+	} else if nothingStaged {
+		return ErrNothingStaged
+	}
+	if opts.SquashNow {
+		// The rebase can't run with unstaged changes lying around.
+		if clean, err := diffQuiet(r); err != nil {
+			return err
+		} else if !clean {
+			return ErrUnstagedChanges
+		}
+	}
+	if err := SaveUndoPoint(r, "fixup-commit"); err != nil {
+		return err
+	}
+	if _, err := run(r, commitArgs(opts.NoVerify, "--fixup="+ref)...); err != nil {
+		return err
+	}
+	if !opts.SquashNow {
+		return nil
+	}
+	cmdargs := []string{"rebase", "-i", "--autosquash"}
+	if hasParent, err := RefExists(r, ref+"^"); err != nil {
+		return err
+	} else if hasParent {
+		cmdargs = append(cmdargs, ref+"^")
+	} else {
+		cmdargs = append(cmdargs, "--root")
+	}
+	// Accept the autosquashed todo list as is, overriding any editor the
+	// user has configured.
+	if _, err := runWithEnv(r, []string{"GIT_SEQUENCE_EDITOR=true"}, cmdargs...); err != nil {
+		return rebaseError(r, err)
+	}
+	return UpdateSubmodules(r, opts.Submodules)
+}
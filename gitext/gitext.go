@@ -0,0 +1,421 @@
+// Package gitext implements git_ext's operations on stacks of branches, each
+// of which tracks the one below it as its upstream. Every function runs git
+// through a Runner, so callers decide how git is invoked and what's echoed.
+package gitext
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LastHash formats the most recent commit with the given `git log` pretty
+// format, e.g. "%H" for its full hash.
+func LastHash(r Runner, format string) (string, error) {
+	return run(r, "log", "-n", "1", "--pretty=format:"+format)
+}
+
+// ErrDetachedHead is returned by operations that need a branch checked out.
+var ErrDetachedHead = errors.New("you are in detached HEAD, please checkout a branch first")
+
+// CurrentBranch returns the name of the checked out branch. When HEAD is
+// detached, rev-parse reports the name as "HEAD" and detached is set.
+func CurrentBranch(r Runner) (name string, detached bool, err error) {
+	name, err = run(r, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", false, err
+	}
+	return name, name == "HEAD", nil
+}
+
+// RequireBranch is CurrentBranch for operations that can't run on a detached
+// HEAD.
+func RequireBranch(r Runner) (string, error) {
+	name, detached, err := CurrentBranch(r)
+	if err != nil {
+		return "", err
+	}
+	if detached {
+		return "", ErrDetachedHead
+	}
+	return name, nil
+}
+
+// Upstream returns the upstream of the checked out branch.
+func Upstream(r Runner) (string, error) {
+	return run(r, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}")
+}
+
+// UpstreamOf returns the upstream of branch.
+func UpstreamOf(r Runner, branch string) (string, error) {
+	return run(r, "rev-parse", "--abbrev-ref", "--symbolic-full-name", branch+"@{u}")
+}
+
+// RefExists reports whether ref resolves to an object.
+func RefExists(r Runner, ref string) (bool, error) {
+	_, err := run(r, "rev-parse", "--verify", "--quiet", ref)
+	if isGitError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RemoteOf returns the remote that upstream is a remote-tracking branch of,
+// e.g. "origin" for "origin/main", or "" if it's a local branch.
+func RemoteOf(r Runner, upstream string) (string, error) {
+	slash := strings.Index(upstream, "/")
+	if slash < 0 {
+		return "", nil
+	}
+	remotes, err := run(r, "remote")
+	if err != nil {
+		return "", err
+	}
+	for _, remote := range strings.Split(remotes, "\n") {
+		if remote == upstream[:slash] {
+			return remote, nil
+		}
+	}
+	return "", nil
+}
+
+// DirtyTreeError is returned by EnsureClean when the working tree has
+// uncommitted changes. Status is the output of `git status`.
+type DirtyTreeError struct {
+	Status string
+}
+
+func (e *DirtyTreeError) Error() string {
+	return e.Status
+}
+
+// TreeChanges lists the paths with uncommitted changes in a working tree.
+// A path can be both staged and unstaged; unmerged paths are both.
+type TreeChanges struct {
+	Staged    []string
+	Unstaged  []string
+	Untracked []string
+}
+
+// Clean reports whether there are no changes at all.
+func (c TreeChanges) Clean() bool {
+	return len(c.Staged) == 0 && len(c.Unstaged) == 0 && len(c.Untracked) == 0
+}
+
+// porcelainFields is how many space-separated fields each kind of
+// `git status --porcelain=v2` line has, the last being the path.
+var porcelainFields = map[byte]int{'1': 9, '2': 10, 'u': 11}
+
+// ParseStatusPorcelain parses the output of `git status --porcelain=v2`,
+// which is the same in every locale. Its lines look like
+//
+//	1 XY sub mH mI mW hH hI path
+//	2 XY sub mH mI mW hH hI score path<tab>origPath
+//	u XY sub m1 m2 m3 mW h1 h2 h3 path
+//	? path
+//
+// where X is the staged status and Y the unstaged one, "." if unchanged.
+// Ignored files ("!" lines) are skipped.
+func ParseStatusPorcelain(output string) (TreeChanges, error) {
+	changes := TreeChanges{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		switch kind := line[0]; kind {
+		case '?':
+			changes.Untracked = append(changes.Untracked, strings.TrimPrefix(line, "? "))
+		case '!':
+		case '1', '2', 'u':
+			parts := strings.SplitN(line, " ", porcelainFields[kind])
+			if len(parts) < porcelainFields[kind] || len(parts[1]) != 2 {
+				return changes, fmt.Errorf("unable to parse status line %q", line)
+			}
+			path := parts[len(parts)-1]
+			if kind == '2' {
+				path = strings.SplitN(path, "\t", 2)[0]
+			}
+			if parts[1][0] != '.' {
+				changes.Staged = append(changes.Staged, path)
+			}
+			if parts[1][1] != '.' {
+				changes.Unstaged = append(changes.Unstaged, path)
+			}
+		default:
+			return changes, fmt.Errorf("unable to parse status line %q", line)
+		}
+	}
+	return changes, nil
+}
+
+// WorkingTreeChanges lists the uncommitted changes in the working tree,
+// including untracked files only if untracked is set.
+func WorkingTreeChanges(r Runner, untracked bool) (TreeChanges, error) {
+	untrackedFiles := "--untracked-files=no"
+	if untracked {
+		untrackedFiles = "--untracked-files=all"
+	}
+	output, err := run(r, "status", "--porcelain=v2", untrackedFiles)
+	if err != nil {
+		return TreeChanges{}, err
+	}
+	return ParseStatusPorcelain(output)
+}
+
+// StrictCleaner is implemented by Runners that say whether untracked files
+// should keep the working tree from counting as clean. By default they
+// don't, since they're often build artifacts.
+type StrictCleaner interface {
+	StrictClean() bool
+}
+
+// strictClean reports whether r wants untracked files to count.
+func strictClean(r Runner) bool {
+	strict, ok := r.(StrictCleaner)
+	return ok && strict.StrictClean()
+}
+
+// AssumeCleaner is implemented by Runners that can say the working tree
+// should be taken as clean without looking, e.g. when a dry run has skipped
+// stashing its changes.
+type AssumeCleaner interface {
+	AssumeClean() bool
+}
+
+// IsClean reports whether the working tree and index match HEAD. Untracked
+// files only count if r is a StrictCleaner that says they should, and
+// nothing does if r is an AssumeCleaner that says so.
+func IsClean(r Runner) (bool, error) {
+	if assume, ok := r.(AssumeCleaner); ok && assume.AssumeClean() {
+		return true, nil
+	}
+	changes, err := WorkingTreeChanges(r, strictClean(r))
+	if err != nil {
+		return false, err
+	}
+	return changes.Clean(), nil
+}
+
+// WorkingTreeStatus reports whether the working tree is clean, as IsClean
+// does, along with the output of `git status` for showing to the user if it
+// isn't.
+func WorkingTreeStatus(r Runner) (clean bool, status string, err error) {
+	if clean, err = IsClean(r); err != nil || clean {
+		return clean, "", err
+	}
+	status, err = run(r, "status")
+	if err != nil {
+		return false, "", err
+	}
+	return false, status, nil
+}
+
+// OperationInProgressError is returned by EnsureNoOperationInProgress when
+// git has stopped partway through Op, e.g. rebase or merge.
+type OperationInProgressError struct {
+	Op string
+}
+
+func (e *OperationInProgressError) Error() string {
+	return fmt.Sprintf("git %s is already in progress; finish it with \"git %s --continue\" or abort it with \"git %s --abort\" first", e.Op, e.Op, e.Op)
+}
+
+// operationMarkers are the files in the .git directory that mark an
+// operation in progress, and the operation each belongs to. git am and
+// rebase share rebase-apply, so am's more specific marker comes first.
+var operationMarkers = []struct {
+	Path string
+	Op   string
+}{
+	{"rebase-merge", "rebase"},
+	{filepath.Join("rebase-apply", "applying"), "am"},
+	{"rebase-apply", "rebase"},
+	{"MERGE_HEAD", "merge"},
+	{"CHERRY_PICK_HEAD", "cherry-pick"},
+	{"REVERT_HEAD", "revert"},
+}
+
+// OperationInProgress returns the git operation (rebase, am, merge,
+// cherry-pick, or revert) that has stopped partway, or "" if there isn't one.
+func OperationInProgress(r Runner) (string, error) {
+	dir, err := gitPath(r, "")
+	if err != nil {
+		return "", err
+	}
+	for _, marker := range operationMarkers {
+		if _, err := os.Stat(filepath.Join(dir, marker.Path)); err == nil {
+			return marker.Op, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// EnsureNoOperationInProgress returns an *OperationInProgressError if a
+// rebase, merge, or the like has stopped partway.
+func EnsureNoOperationInProgress(r Runner) error {
+	op, err := OperationInProgress(r)
+	if err != nil {
+		return err
+	}
+	if op != "" {
+		return &OperationInProgressError{Op: op}
+	}
+	return nil
+}
+
+// EnsureClean returns an *OperationInProgressError if a rebase, merge, or the
+// like has stopped partway, or else a *DirtyTreeError if the working tree
+// isn't clean, as IsClean decides.
+func EnsureClean(r Runner) error {
+	if err := EnsureNoOperationInProgress(r); err != nil {
+		return err
+	}
+	clean, status, err := WorkingTreeStatus(r)
+	if err != nil {
+		return err
+	}
+	if !clean {
+		return &DirtyTreeError{Status: status}
+	}
+	return nil
+}
+
+// gitPath returns the absolute path of name inside the .git directory of the
+// current worktree.
+func gitPath(r Runner, name string) (string, error) {
+	dir, err := run(r, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// gitPathExists reports whether name exists inside the .git directory.
+func gitPathExists(r Runner, name string) (bool, error) {
+	path, err := gitPath(r, name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SubmoduleOptions controls how operations that move HEAD bring submodules
+// along.
+type SubmoduleOptions struct {
+	// Skip leaves submodules alone.
+	Skip bool
+	// BestEffort passes submodule errors to Warn instead of failing.
+	BestEffort bool
+	// Jobs, if positive, updates this many submodules in parallel.
+	Jobs int
+	// Warn is called with the errors ignored in best-effort mode.
+	Warn func(error)
+}
+
+// HasSubmodules reports whether the checked out tree has a .gitmodules file.
+func HasSubmodules(r Runner) (bool, error) {
+	dir, err := run(r, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gitmodules")); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateSubmodules brings submodules in line with HEAD, as opts allows.
+func UpdateSubmodules(r Runner, opts SubmoduleOptions) error {
+	if opts.Skip {
+		return nil
+	}
+	err := updateSubmodules(r, opts.Jobs)
+	if err != nil && opts.BestEffort {
+		if opts.Warn != nil {
+			opts.Warn(err)
+		}
+		return nil
+	}
+	return err
+}
+
+func updateSubmodules(r Runner, jobs int) error {
+	if present, err := HasSubmodules(r); err != nil || !present {
+		return err
+	}
+	if _, err := run(r, "submodule", "init"); err != nil {
+		return err
+	}
+	cmdargs := []string{"submodule", "update", "--recursive"}
+	if jobs > 0 {
+		cmdargs = append(cmdargs, "--jobs", strconv.Itoa(jobs))
+	}
+	_, err := run(r, cmdargs...)
+	return err
+}
+
+// Checkout checks out branch and updates submodules to match.
+func Checkout(r Runner, branch string, submodules SubmoduleOptions) error {
+	if _, err := run(r, "checkout", branch); err != nil {
+		return err
+	}
+	return UpdateSubmodules(r, submodules)
+}
+
+// UndoRefPrefix namespaces the refs recording where each branch was before
+// the last destructive operation touched it.
+const UndoRefPrefix = "refs/git_ext/undo/"
+
+// ErrNothingToUndo is returned by Undo when no undo point is recorded.
+var ErrNothingToUndo = errors.New("there's no git_ext operation to undo on this branch")
+
+// SaveUndoPoint records the current branch's HEAD so that Undo can restore
+// it. op names the operation about to modify the branch.
+func SaveUndoPoint(r Runner, op string) error {
+	branch, detached, err := CurrentBranch(r)
+	if err != nil || detached {
+		return err
+	}
+	_, err = run(r, "update-ref", "-m", "git_ext: before "+op, UndoRefPrefix+branch, "HEAD")
+	return err
+}
+
+// Undo resets the current branch to where it was before the last destructive
+// operation on it.
+func Undo(r Runner, submodules SubmoduleOptions) error {
+	branch, err := RequireBranch(r)
+	if err != nil {
+		return err
+	}
+	undoRef := UndoRefPrefix + branch
+	target, err := run(r, "rev-parse", "--verify", "--quiet", undoRef)
+	if isGitError(err) {
+		return ErrNothingToUndo
+	} else if err != nil {
+		return err
+	}
+	if err := EnsureClean(r); err != nil {
+		return err
+	}
+	if _, err := run(r, "reset", "--hard", target, "--"); err != nil {
+		return err
+	}
+	if _, err := run(r, "update-ref", "-d", undoRef); err != nil {
+		return err
+	}
+	return UpdateSubmodules(r, submodules)
+}
@@ -0,0 +1,248 @@
+package gitext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCurrentBranch(t *testing.T) {
+	tests := []struct {
+		output       string
+		wantName     string
+		wantDetached bool
+	}{
+		{"main\n", "main", false},
+		{"feat/a-b\n", "feat/a-b", false},
+		{"HEAD\n", "HEAD", true},
+	}
+	for _, test := range tests {
+		f := &fakeRunner{outputs: map[string]string{"rev-parse --abbrev-ref HEAD": test.output}}
+		name, detached, err := CurrentBranch(f)
+		if err != nil {
+			t.Errorf("CurrentBranch with %q: %v", test.output, err)
+			continue
+		}
+		if name != test.wantName || detached != test.wantDetached {
+			t.Errorf("CurrentBranch with %q = %q, %v; want %q, %v", test.output, name, detached, test.wantName, test.wantDetached)
+		}
+	}
+}
+
+func TestRequireBranchDetached(t *testing.T) {
+	f := &fakeRunner{outputs: map[string]string{"rev-parse --abbrev-ref HEAD": "HEAD\n"}}
+	if _, err := RequireBranch(f); err != ErrDetachedHead {
+		t.Errorf("RequireBranch on a detached HEAD returned %v, want ErrDetachedHead", err)
+	}
+}
+
+func TestOperationInProgress(t *testing.T) {
+	tests := []struct {
+		marker string
+		dir    bool
+		want   string
+	}{
+		{marker: "", want: ""},
+		{marker: "rebase-merge", dir: true, want: "rebase"},
+		{marker: "rebase-apply", dir: true, want: "rebase"},
+		{marker: filepath.Join("rebase-apply", "applying"), want: "am"},
+		{marker: "MERGE_HEAD", want: "merge"},
+		{marker: "CHERRY_PICK_HEAD", want: "cherry-pick"},
+		{marker: "REVERT_HEAD", want: "revert"},
+	}
+	for _, test := range tests {
+		gitDir, err := ioutil.TempDir("", "git_ext_gitdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(gitDir)
+		if test.marker != "" {
+			path := filepath.Join(gitDir, test.marker)
+			if test.dir {
+				err = os.MkdirAll(path, 0755)
+			} else if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = ioutil.WriteFile(path, []byte("1a2b3c4\n"), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		f := &fakeRunner{outputs: map[string]string{"rev-parse --absolute-git-dir": gitDir + "\n"}}
+		op, err := OperationInProgress(f)
+		if err != nil {
+			t.Errorf("with %q: %v", test.marker, err)
+			continue
+		}
+		if op != test.want {
+			t.Errorf("with %q, OperationInProgress = %q, want %q", test.marker, op, test.want)
+		}
+		err = EnsureNoOperationInProgress(f)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("with nothing in progress, EnsureNoOperationInProgress returned %v", err)
+			}
+		} else if opErr, ok := err.(*OperationInProgressError); !ok || opErr.Op != test.want {
+			t.Errorf("with %q, EnsureNoOperationInProgress returned %v", test.marker, err)
+		}
+	}
+}
+
+const (
+	statusModified = "1 .M N... 100644 100644 100644 3b18e512dba79e4c8300dd08aeb37f8e728b8dad 3b18e512dba79e4c8300dd08aeb37f8e728b8dad file.txt\n"
+	statusCommand  = "status --porcelain=v2 --untracked-files=no"
+)
+
+func TestIsClean(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{"no changes", "", true},
+		{"modified", statusModified, false},
+		{"ignored files only", "! build/out.o\n", true},
+	}
+	for _, test := range tests {
+		f := &fakeRunner{outputs: map[string]string{statusCommand: test.output, "status": "Changes not staged for commit:"}}
+		clean, status, err := WorkingTreeStatus(f)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if clean != test.want {
+			t.Errorf("%s: clean = %v, want %v", test.name, clean, test.want)
+		}
+		// The human-readable status is only needed to show what's dirty.
+		if clean && len(f.calls) > 1 {
+			t.Errorf("%s: ran %v for a clean tree", test.name, f.calls)
+		} else if !clean && status != "Changes not staged for commit:" {
+			t.Errorf("%s: status is %q", test.name, status)
+		}
+	}
+}
+
+func TestParseStatusPorcelain(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   TreeChanges
+	}{
+		{"empty", "", TreeChanges{}},
+		{"unstaged", statusModified, TreeChanges{Unstaged: []string{"file.txt"}}},
+		{
+			name:   "staged",
+			output: "1 A. N... 000000 100644 100644 0000000000000000000000000000000000000000 3b18e512dba79e4c8300dd08aeb37f8e728b8dad new.txt\n",
+			want:   TreeChanges{Staged: []string{"new.txt"}},
+		},
+		{
+			name:   "staged and unstaged",
+			output: "1 MM N... 100644 100644 100644 3b18e512dba79e4c8300dd08aeb37f8e728b8dad 3b18e512dba79e4c8300dd08aeb37f8e728b8dad both.txt\n",
+			want:   TreeChanges{Staged: []string{"both.txt"}, Unstaged: []string{"both.txt"}},
+		},
+		{
+			name:   "path with spaces",
+			output: "1 .D N... 100644 100644 000000 3b18e512dba79e4c8300dd08aeb37f8e728b8dad 3b18e512dba79e4c8300dd08aeb37f8e728b8dad my notes.txt\n",
+			want:   TreeChanges{Unstaged: []string{"my notes.txt"}},
+		},
+		{
+			name:   "renamed",
+			output: "2 R. N... 100644 100644 100644 3b18e512dba79e4c8300dd08aeb37f8e728b8dad 3b18e512dba79e4c8300dd08aeb37f8e728b8dad R100 new name.txt\told name.txt\n",
+			want:   TreeChanges{Staged: []string{"new name.txt"}},
+		},
+		{
+			name:   "unmerged",
+			output: "u UU N... 100644 100644 100644 100644 3b18e512dba79e4c8300dd08aeb37f8e728b8dad 3b18e512dba79e4c8300dd08aeb37f8e728b8dad 3b18e512dba79e4c8300dd08aeb37f8e728b8dad conflict.txt\n",
+			want:   TreeChanges{Staged: []string{"conflict.txt"}, Unstaged: []string{"conflict.txt"}},
+		},
+		{"untracked", "? build/out.o\n? notes.txt\n", TreeChanges{Untracked: []string{"build/out.o", "notes.txt"}}},
+		{"ignored", "! build/out.o\n", TreeChanges{}},
+		{
+			name:   "mixed",
+			output: statusModified + "? notes.txt\n",
+			want:   TreeChanges{Unstaged: []string{"file.txt"}, Untracked: []string{"notes.txt"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseStatusPorcelain(test.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseStatusPorcelain returned %+v, want %+v", got, test.want)
+			}
+			if got.Clean() != (test.want.Staged == nil && test.want.Unstaged == nil && test.want.Untracked == nil) {
+				t.Errorf("Clean() = %v", got.Clean())
+			}
+		})
+	}
+}
+
+func TestParseStatusPorcelainErrors(t *testing.T) {
+	for _, output := range []string{
+		"1 .M file.txt\n",
+		"1 M N... 100644 100644 100644 3b18e512 3b18e512 file.txt\n",
+		" M file.txt\n",
+		"# branch.oid 3b18e512\n",
+	} {
+		if changes, err := ParseStatusPorcelain(output); err == nil {
+			t.Errorf("ParseStatusPorcelain(%q) = %+v, want an error", output, changes)
+		}
+	}
+}
+
+// strictRunner is a fakeRunner that's a StrictCleaner.
+type strictRunner struct {
+	*fakeRunner
+	strict bool
+}
+
+func (s strictRunner) StrictClean() bool {
+	return s.strict
+}
+
+func TestIsCleanUntracked(t *testing.T) {
+	outputs := map[string]string{
+		statusCommand: "",
+		"status --porcelain=v2 --untracked-files=all": "? notes.txt\n",
+	}
+	tests := []struct {
+		name string
+		r    Runner
+		want bool
+	}{
+		{"plain runner", &fakeRunner{outputs: outputs}, true},
+		{"not strict", strictRunner{&fakeRunner{outputs: outputs}, false}, true},
+		{"strict", strictRunner{&fakeRunner{outputs: outputs}, true}, false},
+	}
+	for _, test := range tests {
+		clean, err := IsClean(test.r)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if clean != test.want {
+			t.Errorf("%s: IsClean = %v with only an untracked file, want %v", test.name, clean, test.want)
+		}
+	}
+}
+
+// assumingRunner is a fakeRunner that's an AssumeCleaner.
+type assumingRunner struct {
+	*fakeRunner
+}
+
+func (assumingRunner) AssumeClean() bool {
+	return true
+}
+
+func TestIsCleanAssumed(t *testing.T) {
+	f := &fakeRunner{outputs: map[string]string{statusCommand: statusModified}}
+	clean, err := IsClean(assumingRunner{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clean || len(f.calls) > 0 {
+		t.Errorf("IsClean = %v after running %v, want true without running git", clean, f.calls)
+	}
+}
@@ -0,0 +1,101 @@
+package gitext
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// networkCommands are the git commands RetryRunner retries.
+var networkCommands = map[string]bool{
+	"fetch":     true,
+	"ls-remote": true,
+	"pull":      true,
+	"push":      true,
+	"submodule": true,
+}
+
+// transientErrors are the pieces of git's stderr that mark a failure as
+// worth retrying.
+var transientErrors = []string{
+	"Could not resolve host",
+	"Connection timed out",
+	"Connection reset by peer",
+	"Operation timed out",
+	"The remote end hung up unexpectedly",
+	"early EOF",
+	"RPC failed",
+	"Temporary failure in name resolution",
+}
+
+// RetryRunner wraps Runner, retrying network commands (fetch, push, and the
+// like) whose failures look transient, with exponential backoff. Other
+// commands and other failures are returned as is.
+type RetryRunner struct {
+	Runner Runner
+	// Retries is how many times a command is retried after its first try.
+	Retries int
+	// Backoff is the delay before the first retry, doubling for each one
+	// after. It defaults to one second.
+	Backoff time.Duration
+	// OnRetry, if set, is called before each retry.
+	OnRetry func(args []string, attempt int, delay time.Duration, err error)
+}
+
+func (r RetryRunner) Run(args []string) (string, error) {
+	return r.retry(args, func() (string, error) {
+		return r.Runner.Run(args)
+	})
+}
+
+func (r RetryRunner) RunWithEnv(env []string, args []string) (string, error) {
+	envRunner, ok := r.Runner.(EnvRunner)
+	if !ok {
+		return "", fmt.Errorf("unable to set the environment for git %s", strings.Join(args, " "))
+	}
+	return r.retry(args, func() (string, error) {
+		return envRunner.RunWithEnv(env, args)
+	})
+}
+
+func (r RetryRunner) retry(args []string, attempt func() (string, error)) (string, error) {
+	output, err := attempt()
+	if !isNetworkCommand(args) {
+		return output, err
+	}
+	delay := r.Backoff
+	if delay == 0 {
+		delay = time.Second
+	}
+	for i := 1; i <= r.Retries && isTransient(err); i++ {
+		if r.OnRetry != nil {
+			r.OnRetry(args, i, delay, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+		output, err = attempt()
+	}
+	return output, err
+}
+
+// isNetworkCommand reports whether args run one of networkCommands, looking
+// past any leading -c options.
+func isNetworkCommand(args []string) bool {
+	for len(args) >= 2 && args[0] == "-c" {
+		args = args[2:]
+	}
+	return len(args) > 0 && networkCommands[args[0]]
+}
+
+func isTransient(err error) bool {
+	gitErr, ok := err.(*GitError)
+	if !ok {
+		return false
+	}
+	for _, pattern := range transientErrors {
+		if strings.Contains(gitErr.Stderr, pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package gitext
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flakyRunner fails its first failures calls with err, then succeeds.
+type flakyRunner struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyRunner) Run(args []string) (string, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return "", f.err
+	}
+	return "ok", nil
+}
+
+var errHostDown = &GitError{Stderr: "fatal: unable to access 'https://example.com/repo.git/': Could not resolve host: example.com", ExitCode: 128}
+
+func TestRetryRunner(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "transient failures", args: []string{"fetch", "origin"}, failures: 2, err: errHostDown, wantCalls: 3},
+		{name: "after -c options", args: []string{"-c", "http.lowSpeedTime=10", "push", "origin", "a"}, failures: 1, err: errHostDown, wantCalls: 2},
+		{name: "out of retries", args: []string{"fetch", "origin"}, failures: 5, err: errHostDown, wantCalls: 4, wantErr: true},
+		{
+			name:      "not transient",
+			args:      []string{"push", "origin", "a"},
+			failures:  1,
+			err:       &GitError{Stderr: "! [rejected] a -> a (non-fast-forward)", ExitCode: 1},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{name: "not a network command", args: []string{"status"}, failures: 1, err: errHostDown, wantCalls: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &flakyRunner{failures: test.failures, err: test.err}
+			output, err := RetryRunner{Runner: f, Retries: 3, Backoff: time.Millisecond}.Run(test.args)
+			if f.calls != test.wantCalls {
+				t.Errorf("ran the command %d times, want %d", f.calls, test.wantCalls)
+			}
+			if test.wantErr {
+				if err != test.err {
+					t.Errorf("returned %v, want %v", err, test.err)
+				}
+			} else if err != nil || output != "ok" {
+				t.Errorf("returned %q, %v; want the successful try's output", output, err)
+			}
+		})
+	}
+}
+
+func TestRetryRunnerBackoff(t *testing.T) {
+	f := &flakyRunner{failures: 3, err: errHostDown}
+	attempts, delays := []int{}, []time.Duration{}
+	runner := RetryRunner{Runner: f, Retries: 3, Backoff: time.Millisecond, OnRetry: func(args []string, attempt int, delay time.Duration, err error) {
+		attempts = append(attempts, attempt)
+		delays = append(delays, delay)
+	}}
+	if _, err := runner.Run([]string{"fetch"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("retries were numbered %v, want %v", attempts, want)
+	}
+	if want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("delays were %v, want %v", delays, want)
+	}
+}
@@ -0,0 +1,128 @@
+package gitext
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Runner runs a git command and returns its stdout. A command that exits with
+// a non-zero status should return a *GitError.
+type Runner interface {
+	Run(args []string) (string, error)
+}
+
+// EnvRunner is implemented by Runners that can run a command with extra
+// environment variables, given as "KEY=value".
+type EnvRunner interface {
+	RunWithEnv(env []string, args []string) (string, error)
+}
+
+// GitError is returned by a Runner when git exits with a non-zero status.
+type GitError struct {
+	Args     []string
+	Stderr   string
+	ExitCode int
+}
+
+func (e *GitError) Error() string {
+	return strings.TrimSpace(e.Stderr)
+}
+
+// ExecRunner runs git as a subprocess.
+type ExecRunner struct {
+	// Git is the executable to run; "git" on the PATH if empty.
+	Git string
+	// Dir is the directory git runs in; the current directory if empty.
+	Dir string
+	// Timeout, if nonzero, bounds how long any single command may run.
+	Timeout time.Duration
+	// OnStart, if set, is called with each command once it has started, so
+	// that it can be signalled while it runs.
+	OnStart func(cmd *exec.Cmd)
+	// Stderr, if set, gets a copy of everything git writes to stderr, even
+	// when it succeeds.
+	Stderr io.Writer
+}
+
+func (e ExecRunner) Run(args []string) (string, error) {
+	return e.RunWithEnv(nil, args)
+}
+
+func (e ExecRunner) RunWithEnv(env []string, args []string) (string, error) {
+	git := e.Git
+	if git == "" {
+		git = "git"
+	}
+	ctx := context.Background()
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	cmdObj := exec.CommandContext(ctx, git, args...)
+	cmdObj.Dir = e.Dir
+	if len(env) > 0 {
+		cmdObj.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmdObj.Stdout = &stdout
+	cmdObj.Stderr = &stderr
+	if e.Stderr != nil {
+		cmdObj.Stderr = io.MultiWriter(&stderr, e.Stderr)
+	}
+	err := cmdObj.Start()
+	if err == nil {
+		if e.OnStart != nil {
+			e.OnStart(cmdObj)
+		}
+		err = cmdObj.Wait()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("git %s timed out after %v", strings.Join(args, " "), e.Timeout)
+	} else if exiterr, ok := err.(*exec.ExitError); ok {
+		return "", &GitError{
+			Args:     args,
+			Stderr:   stderr.String(),
+			ExitCode: exiterr.ExitCode(),
+		}
+	} else if err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// run runs git through r and trims the whitespace around its output.
+func run(r Runner, args ...string) (string, error) {
+	output, err := r.Run(args)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// runWithEnv is run with env added to git's environment. It fails if r isn't
+// an EnvRunner.
+func runWithEnv(r Runner, env []string, args ...string) (string, error) {
+	envRunner, ok := r.(EnvRunner)
+	if !ok {
+		return "", fmt.Errorf("unable to set the environment for git %s", strings.Join(args, " "))
+	}
+	output, err := envRunner.RunWithEnv(env, args)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// isGitError reports whether err is a *GitError, i.e. git ran and failed
+// rather than not running at all.
+func isGitError(err error) bool {
+	_, ok := err.(*GitError)
+	return ok
+}
@@ -0,0 +1,85 @@
+package gitext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRunner answers git commands from canned output, keyed by the command
+// line without "git", and records every command it's asked to run. Commands
+// it has no answer for fail as git would for an unknown ref.
+type fakeRunner struct {
+	outputs map[string]string
+	errors  map[string]error
+	calls   []string
+}
+
+func (f *fakeRunner) Run(args []string) (string, error) {
+	cmdline := strings.Join(args, " ")
+	f.calls = append(f.calls, cmdline)
+	if err, ok := f.errors[cmdline]; ok {
+		return "", err
+	}
+	if output, ok := f.outputs[cmdline]; ok {
+		return output, nil
+	}
+	return "", &GitError{Args: args, Stderr: "fatal: no canned output for git " + cmdline, ExitCode: 128}
+}
+
+// ran reports whether any command f was asked to run starts with prefix.
+func (f *fakeRunner) ran(prefix string) bool {
+	for _, call := range f.calls {
+		if strings.HasPrefix(call, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sleepingGit writes a script that stands in for git and sleeps for a while,
+// returning its path.
+func sleepingGit(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "git_ext_sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "git")
+	// exec, so that killing the script kills the sleep too.
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecRunnerTimeout(t *testing.T) {
+	runner := ExecRunner{Git: sleepingGit(t), Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := runner.Run([]string{"fetch", "origin"})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the command ran for %v despite a %v timeout", elapsed, runner.Timeout)
+	}
+	if err == nil {
+		t.Fatal("Run returned no error for a command that timed out")
+	}
+	if !strings.Contains(err.Error(), "git fetch origin timed out after 50ms") {
+		t.Errorf("Run returned %q, want a timeout error", err)
+	}
+	if isGitError(err) {
+		t.Error("a timeout is reported as git having failed")
+	}
+}
+
+func TestExecRunnerNoTimeout(t *testing.T) {
+	output, err := ExecRunner{}.Run([]string{"--version"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output, "git version") {
+		t.Errorf("git --version printed %q", output)
+	}
+}
@@ -0,0 +1,222 @@
+package gitext
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Branch is a node in the tree of branches, linked to the branches that
+// track it as their upstream.
+type Branch struct {
+	Desc       BranchDescriptor
+	Downstream []*Branch
+	// HasUpstream is set when the branch's upstream is also in the tree.
+	HasUpstream bool
+}
+
+// BranchDescriptor describes one branch.
+type BranchDescriptor struct {
+	Current      bool
+	Name         string
+	Sha          string
+	Upstream     string
+	Status       string
+	Message      string
+	Ahead        int
+	Behind       int
+	Detached     bool
+	Worktree     bool
+	WorktreePath string
+	Remote       bool
+	AliasOf      string
+	// Description is the first line of branch.<name>.description. The tree
+	// functions leave it empty; see BranchDescriptions.
+	Description string
+	// CommitDate is when the branch's tip was committed, relative to now,
+	// e.g. "3 weeks ago". Author is who wrote it.
+	CommitDate string
+	Author     string
+}
+
+// AheadBehind counts the commits on branch that aren't on upstream, and vice
+// versa.
+func AheadBehind(r Runner, branch string, upstream string) (ahead int, behind int, err error) {
+	counts, err := run(r, "rev-list", "--left-right", "--count", branch+"..."+upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = fmt.Sscanf(counts, "%d\t%d", &ahead, &behind)
+	return ahead, behind, err
+}
+
+// refFormat asks for-each-ref for everything the tree needs about each branch
+// in one call, as NUL-separated fields parsed by parseRefEntry.
+var refFormat = strings.Join([]string{
+	"%(HEAD)",
+	"%(refname)",
+	"%(refname:short)",
+	"%(objectname)",
+	"%(upstream:short)",
+	"%(upstream:track,nobracket)",
+	"%(worktreepath)",
+	"%(symref)",
+	"%(contents:subject)",
+	"%(committerdate:relative)",
+	"%(authorname)",
+}, "%00")
+
+// parseRefEntry parses one line of `git for-each-ref --format=<refFormat>`
+// output. Symbolic refs like origin/HEAD are returned with AliasOf set.
+func parseRefEntry(refEntry string) (BranchDescriptor, error) {
+	fields := strings.Split(refEntry, "\x00")
+	if len(fields) != 11 {
+		return BranchDescriptor{}, fmt.Errorf("unable to parse ref line %q", refEntry)
+	}
+	descriptor := BranchDescriptor{
+		Current:      strings.TrimSpace(fields[0]) == "*",
+		Name:         fields[2],
+		Sha:          fields[3],
+		Upstream:     fields[4],
+		Status:       fields[5],
+		WorktreePath: fields[6],
+		AliasOf:      fields[7],
+		Message:      fields[8],
+		CommitDate:   fields[9],
+		Author:       fields[10],
+		Remote:       strings.HasPrefix(fields[1], "refs/remotes/"),
+	}
+	descriptor.Worktree = descriptor.WorktreePath != "" && !descriptor.Current
+	for _, count := range strings.Split(descriptor.Status, ", ") {
+		if strings.HasPrefix(count, "ahead ") {
+			descriptor.Ahead, _ = strconv.Atoi(strings.TrimPrefix(count, "ahead "))
+		} else if strings.HasPrefix(count, "behind ") {
+			descriptor.Behind, _ = strconv.Atoi(strings.TrimPrefix(count, "behind "))
+		}
+	}
+	return descriptor, nil
+}
+
+// BranchTree lists local branches with a single for-each-ref and links them
+// into a forest by upstream. It returns the roots (branches whose upstream
+// isn't a local branch), sorted by name, along with a map of all branches by
+// name.
+func BranchTree(r Runner) ([]*Branch, map[string]*Branch, error) {
+	return buildBranchTree(r, false)
+}
+
+// BranchTreeWithRemotes is BranchTree with remote-tracking branches included
+// as nodes too.
+func BranchTreeWithRemotes(r Runner) ([]*Branch, map[string]*Branch, error) {
+	return buildBranchTree(r, true)
+}
+
+func buildBranchTree(r Runner, includeRemotes bool) ([]*Branch, map[string]*Branch, error) {
+	cmdargs := []string{"for-each-ref", "--format=" + refFormat, "refs/heads"}
+	if includeRemotes {
+		cmdargs = append(cmdargs, "refs/remotes")
+	}
+	refOutput, err := run(r, cmdargs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	branchMap := map[string]*Branch{}
+	if refOutput == "" {
+		return []*Branch{}, branchMap, nil
+	}
+	for _, ref := range strings.Split(refOutput, "\n") {
+		desc, err := parseRefEntry(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		if desc.AliasOf != "" {
+			continue
+		}
+		branchMap[desc.Name] = &Branch{Desc: desc, Downstream: []*Branch{}, HasUpstream: false}
+	}
+	for _, br := range branchMap {
+		if upstreamBranch, exists := branchMap[br.Desc.Upstream]; exists {
+			upstreamBranch.Downstream = append(branchMap[br.Desc.Upstream].Downstream, br)
+			branchMap[br.Desc.Upstream] = upstreamBranch
+			br.HasUpstream = true
+		}
+	}
+	rootBranches := []*Branch{}
+	for _, br := range branchMap {
+		if !br.HasUpstream {
+			rootBranches = append(rootBranches, br)
+		}
+		sortBranches(br.Downstream)
+	}
+	sortBranches(rootBranches)
+	return rootBranches, branchMap, nil
+}
+
+func sortBranches(branches []*Branch) {
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].Desc.Name < branches[j].Desc.Name
+	})
+}
+
+// StackOrder lists the branches under roots so that every branch comes after
+// its upstream.
+func StackOrder(roots []*Branch) []*Branch {
+	ordered := []*Branch{}
+	for _, root := range roots {
+		ordered = append(ordered, root)
+		ordered = append(ordered, StackOrder(root.Downstream)...)
+	}
+	return ordered
+}
+
+// BranchDescriptions reads every branch.<name>.description from git config,
+// keeping the first line of each.
+func BranchDescriptions(r Runner) (map[string]string, error) {
+	descriptions := map[string]string{}
+	output, err := run(r, "config", "--null", "--get-regexp", `^branch\..*\.description$`)
+	if gitErr, ok := err.(*GitError); ok && gitErr.ExitCode == 1 {
+		// None are set.
+		return descriptions, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range strings.Split(output, "\x00") {
+		newline := strings.Index(entry, "\n")
+		if newline < 0 {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(entry[:newline], "branch."), ".description")
+		description := strings.TrimSpace(entry[newline+1:])
+		if i := strings.Index(description, "\n"); i >= 0 {
+			description = description[:i]
+		}
+		descriptions[name] = description
+	}
+	return descriptions, nil
+}
+
+// ChainToRoot follows upstreams from branch through branches, as returned by
+// BranchTree, until it reaches one that isn't a local branch (typically a
+// remote-tracking branch like origin/main) or a branch with no upstream. It
+// returns the chain from that root down to branch, without running git.
+func ChainToRoot(branches map[string]*Branch, branch string) ([]string, error) {
+	br, ok := branches[branch]
+	if !ok {
+		return nil, fmt.Errorf("no local branch named %s", branch)
+	}
+	chain := []string{branch}
+	visited := map[string]bool{branch: true}
+	for br.Desc.Upstream != "" {
+		upstream := br.Desc.Upstream
+		if visited[upstream] {
+			return nil, newUpstreamCycleError(upstream, chain)
+		}
+		chain = append([]string{upstream}, chain...)
+		if br, ok = branches[upstream]; !ok {
+			break
+		}
+		visited[upstream] = true
+	}
+	return chain, nil
+}
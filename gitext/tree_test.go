@@ -0,0 +1,126 @@
+package gitext
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// branchMap links descriptors into a map like BranchTree's, by name.
+func branchMap(descs ...BranchDescriptor) map[string]*Branch {
+	branches := map[string]*Branch{}
+	for _, desc := range descs {
+		branches[desc.Name] = &Branch{Desc: desc}
+	}
+	for _, br := range branches {
+		if upstream, ok := branches[br.Desc.Upstream]; ok {
+			upstream.Downstream = append(upstream.Downstream, br)
+			br.HasUpstream = true
+		}
+	}
+	return branches
+}
+
+func TestChainToRoot(t *testing.T) {
+	branches := branchMap(
+		BranchDescriptor{Name: "a", Upstream: "origin/main"},
+		BranchDescriptor{Name: "b", Upstream: "a"},
+		BranchDescriptor{Name: "lone"},
+	)
+	tests := []struct {
+		branch string
+		want   []string
+	}{
+		{"b", []string{"origin/main", "a", "b"}},
+		{"a", []string{"origin/main", "a"}},
+		{"lone", []string{"lone"}},
+	}
+	for _, test := range tests {
+		chain, err := ChainToRoot(branches, test.branch)
+		if err != nil {
+			t.Errorf("ChainToRoot(%s): %v", test.branch, err)
+		} else if !reflect.DeepEqual(chain, test.want) {
+			t.Errorf("ChainToRoot(%s) = %v, want %v", test.branch, chain, test.want)
+		}
+	}
+}
+
+func TestChainToRootCycle(t *testing.T) {
+	branches := branchMap(
+		BranchDescriptor{Name: "a", Upstream: "b"},
+		BranchDescriptor{Name: "b", Upstream: "a"},
+		BranchDescriptor{Name: "c", Upstream: "b"},
+	)
+	_, err := ChainToRoot(branches, "c")
+	cycleErr, ok := err.(*UpstreamCycleError)
+	if !ok {
+		t.Fatalf("ChainToRoot returned %v, want an *UpstreamCycleError", err)
+	}
+	if want := []string{"b", "a", "b"}; !reflect.DeepEqual(cycleErr.Branches, want) {
+		t.Errorf("cycle is %v, want %v", cycleErr.Branches, want)
+	}
+}
+
+// refLine builds a line of for-each-ref output in refFormat from its fields.
+func refLine(fields ...string) string {
+	return strings.Join(fields, "\x00")
+}
+
+func TestParseRefEntryWorktree(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want BranchDescriptor
+	}{
+		{
+			name: "in another worktree",
+			line: refLine(" ", "refs/heads/feat-c", "feat-c", "1a2b3c4", "origin/main", "", "/home/me/src/feat-c", "", "Elsewhere", "2 days ago", "Me"),
+			want: BranchDescriptor{Name: "feat-c", Sha: "1a2b3c4", Upstream: "origin/main", Worktree: true, WorktreePath: "/home/me/src/feat-c", Message: "Elsewhere", CommitDate: "2 days ago", Author: "Me"},
+		},
+		{
+			name: "checked out here",
+			line: refLine("*", "refs/heads/feat-a", "feat-a", "1a2b3c4", "origin/main", "ahead 1", "/home/me/src/main", "", "Here", "2 days ago", "Me"),
+			want: BranchDescriptor{Current: true, Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Status: "ahead 1", Ahead: 1, WorktreePath: "/home/me/src/main", Message: "Here", CommitDate: "2 days ago", Author: "Me"},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseRefEntry(test.line)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseRefEntry returned\n%+v\nwant\n%+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBranchTreeWithRemotes(t *testing.T) {
+	refs := []string{
+		refLine("*", "refs/heads/feat-a", "feat-a", "1a2b3c4", "origin/main", "ahead 1", "", "", "Add a", "", ""),
+		refLine(" ", "refs/heads/feat-b", "feat-b", "5d6e7f8", "feat-a", "", "", "", "Add b", "", ""),
+		refLine(" ", "refs/remotes/origin/HEAD", "origin/HEAD", "9a8b7c6", "", "", "", "refs/remotes/origin/main", "Base", "", ""),
+		refLine(" ", "refs/remotes/origin/main", "origin/main", "9a8b7c6", "", "", "", "", "Base", "", ""),
+	}
+	f := &fakeRunner{outputs: map[string]string{
+		"for-each-ref --format=" + refFormat + " refs/heads refs/remotes": strings.Join(refs, "\n") + "\n",
+	}}
+	roots, branches, err := BranchTreeWithRemotes(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := branches["origin/HEAD"]; ok {
+		t.Error("the origin/HEAD alias is a node in the tree")
+	}
+	if len(roots) != 1 || roots[0].Desc.Name != "origin/main" || !roots[0].Desc.Remote {
+		t.Fatalf("roots are %v, want just origin/main", roots)
+	}
+	order := []string{}
+	for _, br := range StackOrder(roots) {
+		order = append(order, br.Desc.Name)
+	}
+	if want := []string{"origin/main", "feat-a", "feat-b"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("branches are in order %v, want %v", order, want)
+	}
+	if !branches["feat-a"].HasUpstream {
+		t.Error("feat-a isn't linked to origin/main")
+	}
+}
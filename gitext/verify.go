@@ -0,0 +1,78 @@
+package gitext
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VerifyError is returned by a fix-up with FixUpOptions.Verify set when the
+// branch doesn't look the way it should afterwards. The fix-up itself has
+// already happened; git_ext undo puts the branch back.
+type VerifyError struct {
+	Problems []string
+}
+
+func (e *VerifyError) Error() string {
+	return "fix_up verification failed:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// commitChange is the change commit makes to its parent, without the line
+// numbers and blob ids that differ when the same change is applied on a
+// different base.
+func commitChange(r Runner, commit string) (string, error) {
+	patch, err := run(r, "diff-tree", "-p", "-U0", "--no-commit-id", "--no-color", "--no-prefix", commit)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(patch, "\n") {
+		if strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "index ") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// verifyFixUp checks that HEAD is built on target and, if commits is
+// non-nil, that the commits on top of target make the same changes as
+// commits, in order.
+func verifyFixUp(r Runner, target string, commits []string) error {
+	problems := []string{}
+	if ancestor, err := IsAncestor(r, target, "HEAD"); err != nil {
+		return err
+	} else if !ancestor {
+		problems = append(problems, fmt.Sprintf("%s isn't an ancestor of HEAD", target))
+	}
+	if commits != nil && len(problems) == 0 {
+		newCommits := []string{}
+		output, err := run(r, "rev-list", "--reverse", target+"..HEAD", "--")
+		if err != nil {
+			return err
+		}
+		if output != "" {
+			newCommits = strings.Split(output, "\n")
+		}
+		if len(newCommits) != len(commits) {
+			problems = append(problems, fmt.Sprintf("expected %d commits on top of %s, found %d", len(commits), target, len(newCommits)))
+		} else {
+			for i, commit := range commits {
+				original, err := commitChange(r, commit)
+				if err != nil {
+					return err
+				}
+				picked, err := commitChange(r, newCommits[i])
+				if err != nil {
+					return err
+				}
+				if original != picked {
+					problems = append(problems, fmt.Sprintf("%s doesn't make the same changes as the original %s", newCommits[i], commit))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+	return nil
+}
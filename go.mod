@@ -23,7 +23,7 @@ require (
 	golang.org/x/sys v0.0.0-20190322080309-f49334f85ddc
 	golang.org/x/tools v0.0.0-20190327180849-dbeab5af4b8d // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
-	gopkg.in/yaml.v2 v2.2.2 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 go 1.13
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// branchInfo is the output of `git_ext list`. Its JSON field names are part
+// of the command's interface, so don't change them.
+type branchInfo struct {
+	Name     string `json:"name"`
+	Upstream string `json:"upstream"`
+	Sha      string `json:"sha"`
+	Ahead    int    `json:"ahead"`
+	Behind   int    `json:"behind"`
+	Current  bool   `json:"current"`
+}
+
+// currentBranchInfo describes the checked out branch. Upstream is empty if it
+// doesn't have one.
+func currentBranchInfo(w io.Writer, verbose verbosity) (branchInfo, error) {
+	git := cliRunner{verbose, w}
+	name, err := gitext.RequireBranch(git)
+	if err != nil {
+		return branchInfo{}, err
+	}
+	sha, err := gitext.LastHash(git, "%H")
+	if err != nil {
+		return branchInfo{}, err
+	}
+	info := branchInfo{Name: name, Sha: sha, Current: true}
+	upstream, err := gitext.Upstream(git)
+	if _, ok := err.(*gitext.GitError); ok {
+		return info, nil
+	} else if err != nil {
+		return branchInfo{}, err
+	}
+	info.Upstream = upstream
+	info.Ahead, info.Behind, err = gitext.AheadBehind(git, name, upstream)
+	return info, err
+}
+
+// allBranchInfo describes every local branch, sorted by name.
+func allBranchInfo(w io.Writer) ([]branchInfo, error) {
+	_, branchMap, err := gitext.BranchTree(cliRunner{verbosityQuiet, w})
+	if err != nil {
+		return nil, err
+	}
+	infos := []branchInfo{}
+	for _, br := range branchMap {
+		desc := br.Desc
+		if desc.Remote {
+			continue
+		}
+		infos = append(infos, branchInfo{
+			Name:     desc.Name,
+			Upstream: desc.Upstream,
+			Sha:      desc.Sha,
+			Ahead:    desc.Ahead,
+			Behind:   desc.Behind,
+			Current:  desc.Current,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// printBranchInfo writes infos as JSON, or as tab-separated lines of name,
+// upstream, sha, ahead, and behind. A single branch is written as a JSON
+// object rather than an array unless asArray is set.
+func printBranchInfo(w io.Writer, infos []branchInfo, asJSON bool, asArray bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if !asArray && len(infos) == 1 {
+			return encoder.Encode(infos[0])
+		}
+		return encoder.Encode(infos)
+	}
+	for _, info := range infos {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", info.Name, info.Upstream, info.Sha, info.Ahead, info.Behind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leafInfo is the output of `git_ext leaves`, with JSON field names that
+// match branchInfo's.
+type leafInfo struct {
+	Name   string `json:"name"`
+	Root   string `json:"root"`
+	Ahead  int    `json:"ahead"`
+	Behind int    `json:"behind"`
+}
+
+// leafBranches describes every local branch that no other branch tracks,
+// i.e. the tip of each stack, sorted by name.
+func leafBranches(w io.Writer) ([]leafInfo, error) {
+	_, branchMap, err := gitext.BranchTree(cliRunner{verbosityQuiet, w})
+	if err != nil {
+		return nil, err
+	}
+	leaves := []leafInfo{}
+	for name, br := range branchMap {
+		if len(br.Downstream) > 0 {
+			continue
+		}
+		chain, err := gitext.ChainToRoot(branchMap, name)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, leafInfo{Name: name, Root: chain[0], Ahead: br.Desc.Ahead, Behind: br.Desc.Behind})
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].Name < leaves[j].Name })
+	return leaves, nil
+}
+
+// printLeaves writes leaves as a JSON array, or as tab-separated lines of
+// name, root, ahead, and behind.
+func printLeaves(w io.Writer, leaves []leafInfo, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(leaves)
+	}
+	for _, leaf := range leaves {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", leaf.Name, leaf.Root, leaf.Ahead, leaf.Behind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printCurrent writes a one-line summary of where HEAD is: the branch, how
+// far ahead of and behind its upstream it is, the upstream, the last
+// commit's sha and subject, and whether the working tree is dirty.
+func printCurrent(w io.Writer) error {
+	git := cliRunner{verbosityQuiet, w}
+	name, detached, err := gitext.CurrentBranch(git)
+	if err != nil {
+		return err
+	}
+	last, err := gitext.LastHash(git, "%H %s")
+	if err != nil {
+		return err
+	}
+	sha, subject := last, ""
+	if space := strings.Index(last, " "); space >= 0 {
+		sha, subject = last[:space], last[space+1:]
+	}
+	commit := colorize(shortSha(sha), "yellow") + " " + subject
+	clean, err := gitext.IsClean(git)
+	if err != nil {
+		return err
+	}
+	if !clean {
+		commit += " " + colorize("(dirty)", "red")
+	}
+	if detached {
+		_, err := fmt.Fprintln(w, colorize("(detached HEAD)", "red")+" "+commit)
+		return err
+	}
+	line := colorize(name, "green")
+	upstream, err := gitext.Upstream(git)
+	if _, ok := err.(*gitext.GitError); ok {
+		line += " " + colorize("(no upstream)", "black+h")
+	} else if err != nil {
+		return err
+	} else {
+		ahead, behind, err := gitext.AheadBehind(git, name, upstream)
+		if err != nil {
+			return err
+		}
+		aheadText, behindText := fmt.Sprintf("↑%d", ahead), fmt.Sprintf("↓%d", behind)
+		if ahead > 0 {
+			aheadText = colorize(aheadText, "yellow")
+		}
+		if behind > 0 {
+			behindText = colorize(behindText, "red")
+		}
+		line += " " + aheadText + " " + behindText + " (" + colorize(upstream, "cyan") + ")"
+	}
+	_, err = fmt.Fprintln(w, line+" "+commit)
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// gitLog, when set by --log, receives a JSON record of every git command
+// rungit runs.
+var gitLog io.Writer
+
+// logOutputLimit caps how much of a command's stdout and stderr is logged.
+const logOutputLimit = 1024
+
+type gitLogEntry struct {
+	Time     string   `json:"time"`
+	Level    string   `json:"level"`
+	Args     []string `json:"args"`
+	ExitCode int      `json:"exit_code"`
+	Duration float64  `json:"duration_seconds"`
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	DryRun   bool     `json:"dry_run,omitempty"`
+}
+
+func openGitLog(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	gitLog = f
+	return f, nil
+}
+
+func truncateForLog(s string) string {
+	if len(s) > logOutputLimit {
+		return s[:logOutputLimit] + "...(truncated)"
+	}
+	return s
+}
+
+// logGitCall records one git invocation to gitLog. Failed commands are logged
+// at "error" level, the rest at "info".
+func logGitCall(entry gitLogEntry, start time.Time) {
+	if gitLog == nil {
+		return
+	}
+	entry.Time = start.Format(time.RFC3339Nano)
+	entry.Duration = time.Since(start).Seconds()
+	entry.Stdout = truncateForLog(entry.Stdout)
+	entry.Stderr = truncateForLog(entry.Stderr)
+	entry.Level = "info"
+	if entry.ExitCode != 0 || entry.Error != "" {
+		entry.Level = "error"
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	gitLog.Write(append(line, '\n'))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cjfuller/git_ext/testutil"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	testutil.Cleanup()
+	os.Exit(code)
+}
+
+func TestDetachedHead(t *testing.T) {
+	repo := testutil.NewRepo(t)
+	defer repo.Close()
+	repo.AddRemote("origin")
+	repo.Stack("origin/main", "feat-a", "feat-b")
+	repo.Checkout("feat-a~0")
+	head := repo.Head()
+	for _, args := range [][]string{{"fu", "-y"}, {"rup", "-y", "origin/main"}, {"up", "-y", "main"}} {
+		result := repo.GitExt(args...)
+		if result.ExitCode != exitDetachedHead {
+			t.Errorf("git_ext %s exited %d, want %d", strings.Join(args, " "), result.ExitCode, exitDetachedHead)
+		}
+		if !strings.Contains(result.Stderr, "detached HEAD") {
+			t.Errorf("git_ext %s printed %q, want it to mention the detached HEAD", strings.Join(args, " "), result.Stderr)
+		}
+	}
+	if repo.Head() != head {
+		t.Error("HEAD moved")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// manifestFile is the name of the manifest export writes next to the
+// patches.
+const manifestFile = "manifest.json"
+
+// patchManifest describes an exported stack. Its JSON field names are read
+// back by import, so don't change them.
+type patchManifest struct {
+	// Base is the branch at the bottom of the stack, and BaseSha the commit
+	// it was at when the stack was exported.
+	Base    string        `json:"base"`
+	BaseSha string        `json:"base_sha"`
+	Stack   []patchBranch `json:"stack"`
+}
+
+// patchBranch is one branch of an exported stack, upstreams first.
+type patchBranch struct {
+	Name     string   `json:"name"`
+	Upstream string   `json:"upstream"`
+	Patches  []string `json:"patches"`
+}
+
+// exportStack writes the stack from its root up to the current branch into
+// dir as numbered patches, one format-patch run per branch, along with a
+// manifest of which patches belong to which branch. dir must be empty or not
+// exist yet. With --dry-run nothing is written; it prints what would be.
+func exportStack(w io.Writer, dir string, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	branch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	chain, err := gitext.ChainToRoot(branchMap, branch)
+	if err != nil {
+		return err
+	}
+	if len(chain) < 2 {
+		return fmt.Errorf("%s has no upstream to export its commits relative to", branch)
+	}
+	// git runs from the top of the repo, so relative paths would land there.
+	if dir, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s isn't empty", dir)
+	}
+	if !dryRun {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	baseSha, err := rungit(w, []string{"rev-parse", chain[0]}, verbosityQuiet)
+	if err != nil {
+		return err
+	}
+	manifest := patchManifest{Base: chain[0], BaseSha: baseSha, Stack: []patchBranch{}}
+	numPatches := 0
+	for i, name := range chain[1:] {
+		upstream := chain[i]
+		output, err := rungit(w, []string{"format-patch", "-o", dir, "--start-number", strconv.Itoa(numPatches + 1), upstream + ".." + name, "--"}, verbose)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			count, err := rungit(w, []string{"rev-list", "--count", upstream + ".." + name}, verbosityQuiet)
+			if err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				return err
+			}
+			numPatches += n
+			manifest.Stack = append(manifest.Stack, patchBranch{Name: name, Upstream: upstream})
+			continue
+		}
+		patches := []string{}
+		for _, path := range strings.Split(output, "\n") {
+			if path != "" {
+				patches = append(patches, filepath.Base(path))
+			}
+		}
+		numPatches += len(patches)
+		manifest.Stack = append(manifest.Stack, patchBranch{Name: name, Upstream: upstream, Patches: patches})
+	}
+	if dryRun {
+		fmt.Fprintf(w, "would write %s listing %d patches from %d branches on %s\n", filepath.Join(dir, manifestFile), numPatches, len(manifest.Stack), manifest.Base)
+		return nil
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, manifestFile), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if verbose != verbosityQuiet {
+		fmt.Fprintf(w, "exported %d patches from %d branches on %s to %s\n", numPatches, len(manifest.Stack), manifest.Base, dir)
+	}
+	return nil
+}
+
+// importStack recreates the stack exported to dir: each branch in the
+// manifest is created on top of the one below it, its patches are applied
+// with git am, and its upstream is set as recorded. The bottom branch starts
+// from the base commit the stack was exported from if it's here, else from
+// the base branch. None of the branches may exist already. If git am stops,
+// so does the import, leaving the am in progress to be resolved.
+func importStack(w io.Writer, dir string, threeWay bool, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return err
+	}
+	var manifest patchManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("unable to read %s: %v", filepath.Join(dir, manifestFile), err)
+	}
+	if len(manifest.Stack) == 0 {
+		return fmt.Errorf("%s doesn't list any branches", filepath.Join(dir, manifestFile))
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	existing := []string{}
+	for _, br := range manifest.Stack {
+		if exists, err := gitext.RefExists(git, "refs/heads/"+br.Name); err != nil {
+			return err
+		} else if exists {
+			existing = append(existing, br.Name)
+		}
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("these branches already exist: %s", strings.Join(existing, ", "))
+	}
+	baseExists, err := gitext.RefExists(git, manifest.Base+"^{commit}")
+	if err != nil {
+		return err
+	}
+	start := manifest.Base
+	if exists, err := gitext.RefExists(git, manifest.BaseSha+"^{commit}"); err != nil {
+		return err
+	} else if exists {
+		start = manifest.BaseSha
+	} else if !baseExists {
+		return fmt.Errorf("neither %s nor the commit it was exported from (%s) is in this repository", manifest.Base, shortSha(manifest.BaseSha))
+	}
+	if err := gitext.EnsureClean(git); err != nil {
+		return err
+	}
+	for i, br := range manifest.Stack {
+		printProgress(w, i+1, len(manifest.Stack), br.Name, verbose)
+		if _, err := rungit(w, []string{"checkout", "--no-track", "-b", br.Name, start}, verbose.steps()); err != nil {
+			return err
+		}
+		if br.Upstream != manifest.Base || baseExists {
+			if _, err := rungit(w, []string{"branch", "--set-upstream-to", br.Upstream}, verbose); err != nil {
+				return err
+			}
+		}
+		if len(br.Patches) > 0 {
+			cmdargs := []string{"am"}
+			if threeWay {
+				cmdargs = append(cmdargs, "--3way")
+			}
+			for _, patch := range br.Patches {
+				cmdargs = append(cmdargs, filepath.Join(dir, patch))
+			}
+			if _, err := rungit(w, cmdargs, verbose); err != nil {
+				msg := fmt.Sprintf("import stopped applying %s's patches", br.Name)
+				if rest := manifest.Stack[i+1:]; len(rest) > 0 {
+					names := []string{}
+					for _, br := range rest {
+						names = append(names, br.Name)
+					}
+					msg += fmt.Sprintf(", so %s weren't created", strings.Join(names, ", "))
+				}
+				return fmt.Errorf("%v\n%s; resolve it and run \"git am --continue\", or \"git am --abort\" to give up", err, msg)
+			}
+		}
+		start = br.Name
+	}
+	return gitext.UpdateSubmodules(git, submodules)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+	"github.com/mattn/go-isatty"
+)
+
+// errNotInteractive is returned instead of prompting when stdin isn't a
+// terminal, so scripts fail rather than hang.
+var errNotInteractive error = &usageError{msg: "stdin is not a terminal; pass the branch name explicitly"}
+
+// stdinIsTerminal reports whether it's safe to prompt on stdin.
+func stdinIsTerminal() bool {
+	fd := os.Stdin.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// promptLine prints prompt and returns the trimmed line typed in response.
+func promptLine(w io.Writer, prompt string) (string, error) {
+	if !stdinIsTerminal() {
+		return "", errNotInteractive
+	}
+	fmt.Fprint(w, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// upstreamCandidates lists the branches offered by selectUpstream: every
+// local branch except the current one, followed by the default branch of each
+// remote (e.g. origin/main).
+func upstreamCandidates(w io.Writer, verbose verbosity) ([]string, error) {
+	current, _, err := gitext.CurrentBranch(cliRunner{verbose, w})
+	if err != nil {
+		return nil, err
+	}
+	locals, err := rungit(w, []string{"for-each-ref", "--format=%(refname:short)", "refs/heads"}, verbose)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := rungit(w, []string{"for-each-ref", "--format=%(symref:short)", "refs/remotes/*/HEAD"}, verbose)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []string{}
+	for _, name := range strings.Split(locals+"\n"+remotes, "\n") {
+		if name != "" && name != current {
+			candidates = append(candidates, name)
+		}
+	}
+	return candidates, nil
+}
+
+// selectUpstream shows a numbered list of candidate upstreams and returns the
+// one picked. A branch name may be typed instead of a number.
+func selectUpstream(w io.Writer, verbose verbosity) (string, error) {
+	if !stdinIsTerminal() {
+		return "", errNotInteractive
+	}
+	candidates, err := upstreamCandidates(w, verbose)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("no candidate upstream branches")
+	}
+	for i, name := range candidates {
+		fmt.Fprintf(w, "%3d) %s\n", i+1, name)
+	}
+	answer, err := promptLine(w, "Upstream branch: ")
+	if err != nil {
+		return "", err
+	}
+	if answer == "" {
+		return "", errors.New("no branch selected")
+	}
+	if n, err := strconv.Atoi(answer); err == nil {
+		if n < 1 || n > len(candidates) {
+			return "", fmt.Errorf("no branch numbered %d", n)
+		}
+		return candidates[n-1], nil
+	}
+	return answer, nil
+}
+
+// promptBranchName asks for the name of a new branch.
+func promptBranchName(w io.Writer) (string, error) {
+	name, err := promptLine(w, "New branch name: ")
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", errors.New("no branch name given")
+	}
+	return name, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// runner is what rungit uses to actually run git. Swap in a fake to run
+// git_ext's logic against canned output.
+var runner gitext.Runner = execRunner{}
+
+// gitStderr, if set, gets a copy of what execRunner's git commands write to
+// stderr.
+var gitStderr io.Writer
+
+func warnRetry(w io.Writer, args []string, attempt int, delay time.Duration, err error) {
+	fmt.Fprintln(w, colorize(fmt.Sprintf("git %s failed (%v); retry %d in %v", strings.Join(args, " "), err, attempt, delay), "yellow"))
+}
+
+// execRunner runs the git binary resolved by resolveGit, from the top level
+// of the repository once it's known (or workDir before then), logging every
+// call to --log. Once git_ext has been interrupted it refuses to run
+// anything.
+type execRunner struct{}
+
+func (r execRunner) Run(args []string) (string, error) {
+	return r.RunWithEnv(nil, args)
+}
+
+func (execRunner) RunWithEnv(env []string, args []string) (string, error) {
+	if interrupted() {
+		return "", errInterrupted
+	}
+	start := time.Now()
+	defer finishedGit()
+	dir := topLevel
+	if dir == "" {
+		dir = workDir
+	}
+	cmdOutput, err := gitext.ExecRunner{Git: gitCmd, Dir: dir, Timeout: gitTimeout, OnStart: startedGit(args), Stderr: gitStderr}.RunWithEnv(env, args)
+	entry := gitLogEntry{Args: args, Stdout: cmdOutput}
+	if gitErr, ok := err.(*gitext.GitError); ok {
+		entry.Stderr = gitErr.Stderr
+		entry.ExitCode = gitErr.ExitCode
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	logGitCall(entry, start)
+	return cmdOutput, err
+}
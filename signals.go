@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// errInterrupted is returned in place of running git once git_ext has been
+// interrupted, so that a multi-step command stops at the step it was on.
+var errInterrupted = errors.New("interrupted")
+
+// interrupts tracks what git_ext is doing, so that an interrupt can be
+// forwarded to the running git and reported with where it happened.
+var interrupts struct {
+	sync.Mutex
+	// cmd and args are the git command that's running, if any.
+	cmd  *exec.Cmd
+	args []string
+	// step describes the branch a multi-step command is on.
+	step string
+	// during is what was going on when the interrupt arrived.
+	during string
+	// signal is the interrupt, once one has arrived.
+	signal os.Signal
+}
+
+// startedGit records cmd as the running git command. It's the OnStart hook
+// for gitext.ExecRunner.
+func startedGit(args []string) func(cmd *exec.Cmd) {
+	return func(cmd *exec.Cmd) {
+		interrupts.Lock()
+		defer interrupts.Unlock()
+		interrupts.cmd = cmd
+		interrupts.args = args
+	}
+}
+
+// finishedGit clears the running git command.
+func finishedGit() {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	interrupts.cmd = nil
+	interrupts.args = nil
+}
+
+// setStep records which branch a multi-step command has got to.
+func setStep(step string) {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	interrupts.step = step
+}
+
+// interrupted reports whether an interrupt has arrived.
+func interrupted() bool {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	return interrupts.signal != nil
+}
+
+// describeGit describes a git command for the interrupt message, e.g.
+// "cherry-pick of abc1234".
+func describeGit(args []string) string {
+	for len(args) >= 2 && args[0] == "-c" {
+		args = args[2:]
+	}
+	if len(args) > 1 && (args[0] == "cherry-pick" || args[0] == "rebase") && !strings.HasPrefix(args[1], "-") {
+		commits := []string{}
+		for _, arg := range args[1:] {
+			commits = append(commits, shortSha(arg))
+		}
+		return args[0] + " of " + strings.Join(commits, ", ")
+	}
+	return "git " + strings.Join(args, " ")
+}
+
+// handleInterrupts catches SIGINT and SIGTERM. If a git command is running,
+// the first is passed on to it so it can clean up after itself, and no
+// further git commands are started; run then returns and main reports where
+// it stopped. Otherwise, or on a second interrupt, git_ext exits right away.
+func handleInterrupts(errW io.Writer) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		interrupts.Lock()
+		interrupts.signal = sig
+		running := interrupts.cmd != nil
+		if running {
+			interrupts.during = describeGit(interrupts.args)
+			interrupts.cmd.Process.Signal(sig)
+		}
+		interrupts.Unlock()
+		if running {
+			<-signals
+		}
+		fmt.Fprintln(errW, interruptMessage())
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// interruptMessage says what git_ext was doing when it was interrupted.
+func interruptMessage() string {
+	interrupts.Lock()
+	defer interrupts.Unlock()
+	msg := "interrupted"
+	if interrupts.during != "" {
+		msg += " during " + interrupts.during
+	}
+	if interrupts.step != "" {
+		msg += " while " + interrupts.step
+	}
+	return colorize(msg, "white:red")
+}
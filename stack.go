@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// stackEntry declares that Child's upstream should be Parent.
+type stackEntry struct {
+	Parent string
+	Child  string
+}
+
+// readStackFile parses a stack file: one "parent child" pair per line, with
+// blank lines and lines starting with # ignored.
+func readStackFile(path string) ([]stackEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []stackEntry{}
+	declared := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"parent child\", got %q", path, lineNum, line)
+		}
+		if prev, ok := declared[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: %s's parent is already declared on line %d", path, lineNum, fields[1], prev)
+		}
+		declared[fields[1]] = lineNum
+		entries = append(entries, stackEntry{Parent: fields[0], Child: fields[1]})
+	}
+	return entries, scanner.Err()
+}
+
+// applyStack sets each declared child's upstream to its parent. Every child
+// must be a local branch and every parent a local or remote-tracking branch,
+// and the result mustn't contain a cycle; nothing is changed unless all of
+// that holds.
+func applyStack(w io.Writer, entries []stackEntry, verbose verbosity) error {
+	_, branchMap, err := gitext.BranchTreeWithRemotes(cliRunner{verbose, w})
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, entry := range entries {
+		if br, ok := branchMap[entry.Child]; !ok || br.Desc.Remote {
+			missing = append(missing, entry.Child)
+		}
+		if _, ok := branchMap[entry.Parent]; !ok {
+			missing = append(missing, entry.Parent)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no such branch: %s", strings.Join(missing, ", "))
+	}
+	changed := []stackEntry{}
+	for _, entry := range entries {
+		if br := branchMap[entry.Child]; br.Desc.Upstream != entry.Parent {
+			br.Desc.Upstream = entry.Parent
+			changed = append(changed, entry)
+		}
+	}
+	for _, entry := range entries {
+		if _, err := gitext.ChainToRoot(branchMap, entry.Child); err != nil {
+			return err
+		}
+	}
+	for _, entry := range changed {
+		if _, err := rungit(w, []string{"branch", "--set-upstream-to", entry.Parent, entry.Child}, verbose); err != nil {
+			return err
+		}
+	}
+	if verbose != verbosityQuiet {
+		fmt.Fprintf(w, "updated %d of %d upstreams\n", len(changed), len(entries))
+	}
+	return nil
+}
+
+// rebaseStack moves the stack from its root up to the current branch onto
+// base: the bottom branch is re-pointed at base and fixed up there, then each
+// branch above it is fixed up on the one below, and the starting branch is
+// checked out again. If a fix-up fails the repo is left as-is so the failure
+// can be resolved.
+func rebaseStack(w io.Writer, base string, opts gitext.FixUpOptions, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	startBranch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	_, branchMap, err := gitext.BranchTreeWithRemotes(git)
+	if err != nil {
+		return err
+	}
+	if _, ok := branchMap[base]; !ok {
+		return fmt.Errorf("no branch named %s", base)
+	}
+	chain, err := gitext.ChainToRoot(branchMap, startBranch)
+	if err != nil {
+		return err
+	}
+	stack := []*gitext.Branch{}
+	for _, name := range chain {
+		if name == base {
+			return fmt.Errorf("%s is part of the stack being rebased", base)
+		}
+		if br, ok := branchMap[name]; ok && !br.Desc.Remote {
+			stack = append(stack, br)
+		}
+	}
+	stack[0].Desc.Upstream = base
+	if err := fixUpEach(w, stack, "rebase-stack", opts, verbose); err != nil {
+		return err
+	}
+	return gitext.Checkout(cliRunner{verbose.steps(), w}, startBranch, submodules)
+}
+
+// logStack prints, for each branch from the bottom of the current stack up to
+// the current branch, the commits it adds over its upstream, indented by how
+// far up the stack it is. With patch, each commit's diff is included.
+func logStack(w io.Writer, patch bool) error {
+	git := cliRunner{verbosityQuiet, w}
+	branch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	chain, err := gitext.ChainToRoot(branchMap, branch)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, colorize(chain[0], "blue"))
+	for i, name := range chain[1:] {
+		upstream := chain[i]
+		cmdargs := []string{"log", "--format=%h %s"}
+		if patch {
+			cmdargs = append(cmdargs, "--patch")
+		}
+		commits, err := rungit(w, append(cmdargs, upstream+".."+name, "--"), verbosityQuiet)
+		if err != nil {
+			return err
+		}
+		indent := strings.Repeat(" ", (i+1)*indentAmount)
+		fmt.Fprintln(w, indent+colorize(name, "green"))
+		if commits == "" {
+			fmt.Fprintln(w, indent+"  (no commits)")
+			continue
+		}
+		for _, line := range strings.Split(commits, "\n") {
+			if line != "" {
+				line = indent + "  " + line
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	return nil
+}
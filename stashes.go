@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// stashEntry is one line of `git stash list`.
+type stashEntry struct {
+	Ref     string
+	Branch  string
+	Message string
+}
+
+// parseStashEntry parses one line of `git stash list` output. Lines look like
+//
+//	stash@{0}: WIP on branch: sha subject
+//	stash@{1}: On branch: message
+//
+// where branch is "(no branch)" for stashes made on a detached HEAD.
+func parseStashEntry(line string) (stashEntry, error) {
+	parts := strings.SplitN(line, ": ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "stash@{") {
+		return stashEntry{}, fmt.Errorf("unable to parse stash line %q", line)
+	}
+	entry := stashEntry{Ref: parts[0]}
+	if len(parts) == 3 {
+		entry.Message = parts[2]
+	}
+	switch {
+	case strings.HasPrefix(parts[1], "WIP on "):
+		entry.Branch = strings.TrimPrefix(parts[1], "WIP on ")
+	case strings.HasPrefix(parts[1], "On "):
+		entry.Branch = strings.TrimPrefix(parts[1], "On ")
+	default:
+		// Stashes made with plumbing can have any message.
+		entry.Message = strings.Join(parts[1:], ": ")
+	}
+	return entry, nil
+}
+
+// printStashes lists the stashes grouped by the branch they were made on,
+// with the current branch's first and highlighted. With currentOnly, only
+// the current branch's are listed.
+func printStashes(w io.Writer, currentOnly bool) error {
+	git := cliRunner{verbosityQuiet, w}
+	current, detached, err := gitext.CurrentBranch(git)
+	if err != nil {
+		return err
+	}
+	if detached {
+		current = "(no branch)"
+	}
+	output, err := rungit(w, []string{"stash", "list"}, verbosityQuiet)
+	if err != nil {
+		return err
+	}
+	byBranch := map[string][]stashEntry{}
+	if output != "" {
+		for _, line := range strings.Split(output, "\n") {
+			entry, err := parseStashEntry(line)
+			if err != nil {
+				return err
+			}
+			byBranch[entry.Branch] = append(byBranch[entry.Branch], entry)
+		}
+	}
+	branches := []string{}
+	for branch := range byBranch {
+		if branch != current && !currentOnly {
+			branches = append(branches, branch)
+		}
+	}
+	sort.Strings(branches)
+	if _, ok := byBranch[current]; ok {
+		branches = append([]string{current}, branches...)
+	}
+	for _, branch := range branches {
+		header := branch
+		if header == "" {
+			header = "(unknown branch)"
+		}
+		if branch == current {
+			fmt.Fprintln(w, colorize(header+" (current)", "green"))
+		} else {
+			fmt.Fprintln(w, header)
+		}
+		for _, entry := range byBranch[branch] {
+			fmt.Fprintf(w, "%s%s: %s\n", strings.Repeat(" ", indentAmount), entry.Ref, entry.Message)
+		}
+	}
+	return nil
+}
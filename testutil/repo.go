@@ -0,0 +1,289 @@
+// Package testutil builds real git repositories in temporary directories for
+// tests to run git_ext and gitext against. Everything runs with a fixed
+// author, committer, and clock and without the user's git config, so output
+// is the same from run to run.
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// epoch is the date of a repo's first commit; each later one is a minute on.
+var epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Repo is a git repository in a temporary directory. Its methods fail the
+// test on any error, so they can be chained without checks. It implements
+// gitext.Runner, so it can be passed straight to gitext's functions.
+type Repo struct {
+	// Dir is the repository's working tree.
+	Dir string
+	t   testing.TB
+	// root holds Dir, a home directory, and any remotes, and is removed by
+	// Close.
+	root    string
+	env     []string
+	commits int
+}
+
+// NewRepo creates a repository with a main branch holding one commit, "base".
+// Call Close when done with it.
+func NewRepo(t testing.TB) *Repo {
+	t.Helper()
+	root, err := ioutil.TempDir("", "git_ext_test")
+	if err != nil {
+		t.Fatalf("unable to create a temporary directory: %v", err)
+	}
+	r := &Repo{Dir: filepath.Join(root, "work"), t: t, root: root}
+	home := filepath.Join(root, "home")
+	for _, dir := range []string{r.Dir, home} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			r.Close()
+			t.Fatalf("unable to create %s: %v", dir, err)
+		}
+	}
+	r.env = []string{
+		"HOME=" + home,
+		"XDG_CONFIG_HOME=" + home,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=Test Author",
+		"GIT_AUTHOR_EMAIL=author@example.com",
+		"GIT_COMMITTER_NAME=Test Committer",
+		"GIT_COMMITTER_EMAIL=committer@example.com",
+		"GIT_TERMINAL_PROMPT=0",
+		"NO_COLOR=1",
+		"LANG=C",
+		"LC_ALL=C",
+	}
+	r.Git("init", "-q")
+	r.Git("symbolic-ref", "HEAD", "refs/heads/main")
+	r.Git("config", "commit.gpgsign", "false")
+	r.Commit("base")
+	return r
+}
+
+// Close removes the repository and everything else NewRepo created.
+func (r *Repo) Close() {
+	os.RemoveAll(r.root)
+}
+
+// Env is the environment every command in the repository runs with, on top
+// of the test's own.
+func (r *Repo) Env() []string {
+	return append([]string{}, r.env...)
+}
+
+// Run runs git in the repository, returning its trimmed stdout or a
+// *gitext.GitError.
+func (r *Repo) Run(args []string) (string, error) {
+	return r.RunWithEnv(nil, args)
+}
+
+// RunWithEnv is Run with extra environment variables, given as "KEY=value".
+func (r *Repo) RunWithEnv(env []string, args []string) (string, error) {
+	out, err := gitext.ExecRunner{Dir: r.Dir}.RunWithEnv(append(r.Env(), env...), args)
+	return strings.TrimSpace(out), err
+}
+
+// Git runs git in the repository and returns its trimmed stdout, failing the
+// test if it exits with an error.
+func (r *Repo) Git(args ...string) string {
+	r.t.Helper()
+	out, err := r.Run(args)
+	if err != nil {
+		r.t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+// WriteFile writes contents to name, relative to the top of the working
+// tree, creating any directories it's in.
+func (r *Repo) WriteFile(name string, contents string) {
+	r.t.Helper()
+	path := filepath.Join(r.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.t.Fatalf("unable to create the directory for %s: %v", name, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		r.t.Fatalf("unable to write %s: %v", name, err)
+	}
+}
+
+// Commit commits a new file named after message, along with anything already
+// staged, and returns the commit's full sha.
+func (r *Repo) Commit(message string) string {
+	r.t.Helper()
+	name := strings.Map(func(c rune) rune {
+		if c == '/' || c == ' ' || c == '\n' {
+			return '_'
+		}
+		return c
+	}, message) + ".txt"
+	r.WriteFile(name, message+"\n")
+	return r.CommitAll(message)
+}
+
+// CommitAll commits every change in the working tree, and returns the
+// commit's full sha. Each commit is dated a minute after the last.
+func (r *Repo) CommitAll(message string) string {
+	r.t.Helper()
+	r.Git("add", "-A")
+	date := epoch.Add(time.Duration(r.commits) * time.Minute).Format(time.RFC3339)
+	r.commits++
+	env := []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date}
+	if _, err := r.RunWithEnv(env, []string{"commit", "-q", "--allow-empty", "-m", message}); err != nil {
+		r.t.Fatalf("committing %q: %v", message, err)
+	}
+	return r.Head()
+}
+
+// Head returns the full sha of HEAD.
+func (r *Repo) Head() string {
+	r.t.Helper()
+	return r.Git("rev-parse", "HEAD")
+}
+
+// Sha returns the full sha of ref.
+func (r *Repo) Sha(ref string) string {
+	r.t.Helper()
+	return r.Git("rev-parse", ref)
+}
+
+// Branch creates branch at upstream's tip, tracking upstream, and checks it
+// out.
+func (r *Repo) Branch(name string, upstream string) {
+	r.t.Helper()
+	r.Git("checkout", "-q", "-b", name, upstream)
+	r.Git("branch", "--set-upstream-to", upstream)
+}
+
+// Stack creates a branch for each of names with one commit on it, each
+// tracking the one before and the first tracking base, and leaves the last
+// checked out. It returns the commits' shas in the same order.
+func (r *Repo) Stack(base string, names ...string) []string {
+	r.t.Helper()
+	shas := []string{}
+	upstream := base
+	for _, name := range names {
+		r.Branch(name, upstream)
+		shas = append(shas, r.Commit(name))
+		upstream = name
+	}
+	return shas
+}
+
+// Checkout checks out ref.
+func (r *Repo) Checkout(ref string) {
+	r.t.Helper()
+	r.Git("checkout", "-q", ref)
+}
+
+// AddRemote creates a bare repository, adds it as the remote name, and
+// pushes main to it, so that name/main can be used as an upstream.
+func (r *Repo) AddRemote(name string) string {
+	r.t.Helper()
+	dir := filepath.Join(r.root, name+".git")
+	if out, err := (gitext.ExecRunner{}).RunWithEnv(r.Env(), []string{"init", "-q", "--bare", dir}); err != nil {
+		r.t.Fatalf("creating remote %s: %v %s", name, err, out)
+	}
+	r.Git("remote", "add", name, dir)
+	r.Git("push", "-q", name, "main")
+	r.Git("fetch", "-q", name)
+	return dir
+}
+
+// Result is the outcome of running git_ext.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+var (
+	buildOnce sync.Once
+	binaryDir string
+	binary    string
+	buildErr  error
+)
+
+// gitExtBinary builds git_ext once per test binary and returns its path.
+// Cleanup removes it.
+func gitExtBinary() (string, error) {
+	buildOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "git_ext_bin")
+		if err != nil {
+			buildErr = err
+			return
+		}
+		binaryDir = dir
+		binary = filepath.Join(dir, "git_ext")
+		out, err := exec.Command("go", "build", "-o", binary, "github.com/cjfuller/git_ext").CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("building git_ext: %v\n%s", err, out)
+		}
+	})
+	return binary, buildErr
+}
+
+// Cleanup removes the git_ext binary GitExt built, if it built one. Call it
+// from TestMain once the package's tests have run:
+//
+//	func TestMain(m *testing.M) {
+//		code := m.Run()
+//		testutil.Cleanup()
+//		os.Exit(code)
+//	}
+func Cleanup() {
+	if binaryDir != "" {
+		os.RemoveAll(binaryDir)
+	}
+}
+
+// GitExt runs git_ext with args in the repository, building it first if
+// this is the first run. Output is uncolored and stdin isn't a terminal, so
+// commands that would prompt need --yes.
+func (r *Repo) GitExt(args ...string) Result {
+	r.t.Helper()
+	path, err := gitExtBinary()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Dir = r.Dir
+	cmd.Env = append(os.Environ(), r.env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	result := Result{}
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			r.t.Fatalf("running git_ext %s: %v", strings.Join(args, " "), err)
+		}
+		result.ExitCode = exitErr.ExitCode()
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	return result
+}
+
+// MustGitExt is GitExt for commands expected to succeed: it fails the test
+// if git_ext exits non-zero, and returns its stdout.
+func (r *Repo) MustGitExt(args ...string) string {
+	r.t.Helper()
+	result := r.GitExt(args...)
+	if result.ExitCode != 0 {
+		r.t.Fatalf("git_ext %s exited %d:\n%s%s", strings.Join(args, " "), result.ExitCode, result.Stdout, result.Stderr)
+	}
+	return result.Stdout
+}
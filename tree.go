@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+var (
+	// \s only matches ASCII whitespace, so names and messages with other
+	// Unicode spaces in them aren't split.
+	branchWhitespaceRe = regexp.MustCompile(`\s+`)
+	branchUpstreamRe   = regexp.MustCompile(`^\[([^\]]*)\] ?(.*)$`)
+)
+
+// parseBranchEntry parses one line of `git branch -vv` output. Lines look like
+//
+//	name sha (worktree path) [upstream: status] message
+//
+// where the bracketed upstream and the status are optional, and the worktree
+// path only appears for branches checked out in another worktree. Remote
+// branches (from `git branch -vva`) are named remotes/<remote>/<branch>, and
+// symbolic ones are listed as "remotes/origin/HEAD -> origin/main" and
+// returned with AliasOf set. The line may be marked with a leading "*" for
+// the current branch or "+" for a branch checked out in another worktree.
+// With a detached HEAD git also lists a "(HEAD detached at sha)"
+// pseudo-branch, which is returned with Detached set. Lines of a plain list like `git branch --merged` have only
+// the marker and the name, and are returned without a Sha.
+func parseBranchEntry(branchEntry string) (gitext.BranchDescriptor, error) {
+	descriptor := gitext.BranchDescriptor{}
+	rest := branchEntry
+	if strings.HasPrefix(rest, "* ") {
+		descriptor.Current = true
+		rest = rest[2:]
+	} else if strings.HasPrefix(rest, "+ ") {
+		descriptor.Worktree = true
+		rest = rest[2:]
+	}
+	rest = strings.TrimLeft(rest, " ")
+
+	if strings.HasPrefix(rest, "(") {
+		end := strings.Index(rest, ")")
+		if end < 0 {
+			return descriptor, fmt.Errorf("unable to parse branch line %q", branchEntry)
+		}
+		descriptor.Name = rest[:end+1]
+		descriptor.Detached = true
+		rest = strings.TrimLeft(rest[end+1:], " ")
+	} else {
+		parts := branchWhitespaceRe.Split(rest, 2)
+		descriptor.Name = parts[0]
+		rest = ""
+		if len(parts) > 1 {
+			rest = parts[1]
+		}
+		// With -a, remote-tracking branches are listed as remotes/<remote>/<branch>,
+		// and symbolic refs like origin/HEAD as "remotes/origin/HEAD -> origin/main".
+		if strings.HasPrefix(descriptor.Name, "remotes/") {
+			descriptor.Name = strings.TrimPrefix(descriptor.Name, "remotes/")
+			descriptor.Remote = true
+		}
+		if strings.HasPrefix(rest, "-> ") {
+			descriptor.AliasOf = strings.TrimPrefix(rest, "-> ")
+			return descriptor, nil
+		}
+	}
+	if rest == "" && descriptor.Name != "" {
+		return descriptor, nil
+	}
+
+	parts := branchWhitespaceRe.Split(rest, 2)
+	descriptor.Sha = parts[0]
+	if descriptor.Name == "" || descriptor.Sha == "" {
+		return descriptor, fmt.Errorf("unable to parse branch line %q", branchEntry)
+	}
+	if len(parts) < 2 {
+		return descriptor, nil
+	}
+	rest = parts[1]
+
+	if descriptor.Worktree && strings.HasPrefix(rest, "(") {
+		if end := strings.Index(rest, ") "); end >= 0 {
+			descriptor.WorktreePath = rest[1:end]
+			rest = rest[end+2:]
+		} else if strings.HasSuffix(rest, ")") {
+			descriptor.WorktreePath = rest[1 : len(rest)-1]
+			rest = ""
+		}
+	}
+
+	if m := branchUpstreamRe.FindStringSubmatch(rest); m != nil && !descriptor.Detached {
+		upstreamAndMaybeStatus := strings.SplitN(m[1], ": ", 2)
+		descriptor.Upstream = upstreamAndMaybeStatus[0]
+		if len(upstreamAndMaybeStatus) > 1 {
+			descriptor.Status = upstreamAndMaybeStatus[1]
+		}
+		rest = m[2]
+	}
+	descriptor.Message = rest
+	return descriptor, nil
+}
+
+// indentAmount is the number of spaces per tree level, set by --indent.
+var indentAmount = 2
+
+func prefixForDepth(depth int) string {
+	return strings.Repeat(" ", indentAmount*depth) + "+-- "
+}
+
+// treeOptions controls how drawBranchTree renders the tree.
+type treeOptions struct {
+	Format string
+	// Template renders each branch when Format is "template".
+	Template *template.Template
+	// MaxDepth limits how many levels of branches are printed under each
+	// root; 0 means no limit.
+	MaxDepth int
+	// Remote includes remote-tracking branches as nodes in the tree.
+	Remote bool
+	// Pattern, if set, limits the tree to branches whose names match this
+	// glob, plus the branches above them.
+	Pattern string
+	// CollapseClean hides branches that are level with their upstream,
+	// except the current branch and those above a branch that isn't.
+	CollapseClean bool
+	// Root, if set, limits the tree to the branches under this branch or
+	// upstream.
+	Root string
+	// Descriptions shows each branch's description from git config.
+	Descriptions bool
+	// ShowDates and ShowAuthors add columns with when each branch's tip was
+	// committed and who wrote it.
+	ShowDates   bool
+	ShowAuthors bool
+	// Sort orders the roots and each branch's downstreams: by "name" (the
+	// default), "sha", or "ahead" (most commits ahead first).
+	Sort string
+}
+
+// upstreamMissing reports whether root has an upstream that's neither a local
+// branch nor on remoteName, or git reports it as gone.
+func upstreamMissing(root *gitext.Branch, branchMap map[string]*gitext.Branch) bool {
+	if _, local := branchMap[root.Desc.Upstream]; local || root.Desc.Upstream == "" {
+		return false
+	}
+	return !strings.HasPrefix(root.Desc.Upstream, remoteName+"/") || root.Desc.Status == "gone"
+}
+
+// upstreamShown reports whether root's upstream is drawn above it. It isn't
+// for remote roots or roots with no upstream, nor for the root of a subtree,
+// whose upstream is a local branch outside of what's drawn.
+func upstreamShown(root *gitext.Branch, branchMap map[string]*gitext.Branch) bool {
+	_, local := branchMap[root.Desc.Upstream]
+	return root.Desc.Upstream != "" && !root.Desc.Remote && !local
+}
+
+// abbrevLength is how many characters of each sha are shown, set by --abbrev.
+var abbrevLength = 7
+
+// shortSha abbreviates sha for display.
+func shortSha(sha string) string {
+	if len(sha) > abbrevLength {
+		return sha[:abbrevLength]
+	}
+	return sha
+}
+
+// treeLine records how to highlight a line printBranchTree writes: green if
+// Branch is checked out, else in Color if it's set. Highlighting has to wait
+// until the columns are aligned, since it colors whole lines.
+type treeLine struct {
+	Branch *gitext.Branch
+	Color  string
+}
+
+type treeLines []treeLine
+
+// messageColumn is the tabs that take a line from the name column to the
+// message column.
+func messageColumn(opts treeOptions) string {
+	tabs := "\t\t"
+	if opts.ShowDates {
+		tabs += "\t"
+	}
+	if opts.ShowAuthors {
+		tabs += "\t"
+	}
+	return tabs
+}
+
+// rootGroup is the roots of the tree that track the same upstream, which is
+// drawn once as a header above them all. Roots with no upstream, and remote
+// roots, are each in a group of their own with no Upstream.
+type rootGroup struct {
+	Upstream string
+	// Missing is set if the upstream is neither a local branch nor on the
+	// remote, or git reports it as gone.
+	Missing bool
+	Roots   []*gitext.Branch
+}
+
+// groupRoots groups rootBranches by upstream, keeping them and the groups in
+// the order they're given.
+func groupRoots(rootBranches []*gitext.Branch, branchMap map[string]*gitext.Branch) []*rootGroup {
+	groups := []*rootGroup{}
+	byUpstream := map[string]*rootGroup{}
+	for _, root := range rootBranches {
+		if !upstreamShown(root, branchMap) {
+			groups = append(groups, &rootGroup{Roots: []*gitext.Branch{root}})
+			continue
+		}
+		group, ok := byUpstream[root.Desc.Upstream]
+		if !ok {
+			group = &rootGroup{Upstream: root.Desc.Upstream}
+			byUpstream[root.Desc.Upstream] = group
+			groups = append(groups, group)
+		}
+		group.Missing = group.Missing || upstreamMissing(root, branchMap)
+		group.Roots = append(group.Roots, root)
+	}
+	return groups
+}
+
+func printTreeRootedAt(w io.Writer, root *gitext.Branch, currDepth int, opts treeOptions, lines *treeLines) {
+	prefix := prefixForDepth(currDepth) + root.Desc.Name
+	if root.Desc.Worktree {
+		prefix += " (worktree)"
+	}
+	outputLine := prefix + "\t" + shortSha(root.Desc.Sha) + "\t"
+	if opts.ShowDates {
+		outputLine += root.Desc.CommitDate + "\t"
+	}
+	if opts.ShowAuthors {
+		outputLine += root.Desc.Author + "\t"
+	}
+	outputLine += root.Desc.Message + "\t"
+	// The tracking status goes in the last, unaligned column.
+	if root.Desc.Upstream != "" {
+		outputLine += formatTrackingStatus(root.Desc)
+	}
+	if root.Desc.Description != "" {
+		outputLine += " " + colorize(root.Desc.Description, "black+h")
+	}
+	fmt.Fprintln(w, outputLine)
+	*lines = append(*lines, treeLine{Branch: root})
+	if opts.MaxDepth > 0 && currDepth >= opts.MaxDepth && len(root.Downstream) > 0 {
+		*lines = append(*lines, treeLine{Branch: printTruncatedSummary(w, root.Downstream, currDepth+1, opts)})
+		return
+	}
+	for _, ds := range root.Downstream {
+		printTreeRootedAt(w, ds, currDepth+1, opts, lines)
+	}
+}
+
+// printTruncatedSummary prints a single line standing in for the branches cut
+// off by --depth, calling out the current branch if it's one of them. It
+// returns the current branch in that case, and nil otherwise.
+func printTruncatedSummary(w io.Writer, hidden []*gitext.Branch, depth int, opts treeOptions) *gitext.Branch {
+	hiddenBranches := gitext.StackOrder(hidden)
+	summary := fmt.Sprintf("(%d more", len(hiddenBranches))
+	var current *gitext.Branch
+	for _, br := range hiddenBranches {
+		if br.Desc.Current {
+			summary += ", including current branch " + br.Desc.Name
+			current = br
+		}
+	}
+	// The summary goes in the message column.
+	fmt.Fprintln(w, prefixForDepth(depth)+"..."+messageColumn(opts)+summary+")\t")
+	return current
+}
+
+// formatTrackingStatus describes how desc compares to its upstream: either
+// the ahead/behind counts, or that the upstream is gone.
+func formatTrackingStatus(desc gitext.BranchDescriptor) string {
+	if desc.Status == "gone" {
+		return colorize("[gone]", "red")
+	}
+	return formatAheadBehind(desc.Ahead, desc.Behind)
+}
+
+func formatAheadBehind(ahead int, behind int) string {
+	aheadText := fmt.Sprintf("ahead %d", ahead)
+	if ahead > 0 {
+		aheadText = colorize(aheadText, "yellow")
+	}
+	behindText := fmt.Sprintf("behind %d", behind)
+	if behind > 0 {
+		behindText = colorize(behindText, "red")
+	}
+	return "[" + aheadText + ", " + behindText + "]"
+}
+
+// sortTree reorders branches and everything under them by key, falling back
+// to the name order gitext.BranchTree already sorted them in.
+func sortTree(branches []*gitext.Branch, key string) error {
+	var less func(a, b gitext.BranchDescriptor) bool
+	switch key {
+	case "", "name":
+		return nil
+	case "sha":
+		less = func(a, b gitext.BranchDescriptor) bool { return a.Sha < b.Sha }
+	case "ahead":
+		less = func(a, b gitext.BranchDescriptor) bool { return a.Ahead > b.Ahead }
+	default:
+		return newUsageError("unknown sort key %q: expected name, sha, or ahead", key)
+	}
+	var sortLevel func(branches []*gitext.Branch)
+	sortLevel = func(branches []*gitext.Branch) {
+		sort.SliceStable(branches, func(i, j int) bool {
+			return less(branches[i].Desc, branches[j].Desc)
+		})
+		for _, br := range branches {
+			sortLevel(br.Downstream)
+		}
+	}
+	sortLevel(branches)
+	return nil
+}
+
+func printBranchTree(w io.Writer, rootBranches []*gitext.Branch, branchMap map[string]*gitext.Branch, opts treeOptions) {
+	outputBuffer := bytes.Buffer{}
+	tw := newColumnWriter(&outputBuffer, 5, 1)
+
+	lines := treeLines{}
+	for _, group := range groupRoots(rootBranches, branchMap) {
+		if group.Upstream != "" {
+			header := treeLine{Color: "blue"}
+			outputLine := prefixForDepth(0) + group.Upstream
+			if group.Missing {
+				header.Color = "red"
+				outputLine += " [missing]"
+			}
+			// Empty cells up to the tracking status, as on branch lines.
+			fmt.Fprintln(tw, outputLine+messageColumn(opts)+"\t")
+			lines = append(lines, header)
+		}
+		for _, root := range group.Roots {
+			// Local roots sit under their upstream's header, or where it
+			// would be for branches with no upstream at all.
+			depth := 1
+			if root.Desc.Remote {
+				depth = 0
+			}
+			printTreeRootedAt(tw, root, depth, opts, &lines)
+		}
+	}
+
+	tw.Flush()
+	// Finally, highlight the current branch (or the summary line hiding it)
+	// in green, and the upstream headers.
+	output := strings.Split(outputBuffer.String(), "\n")
+	for i, line := range lines {
+		switch {
+		case line.Branch != nil && line.Branch.Desc.Current:
+			fmt.Fprintln(w, colorize(output[i], "green"))
+		case line.Color != "":
+			fmt.Fprintln(w, colorize(output[i], line.Color))
+		default:
+			fmt.Fprintln(w, output[i])
+		}
+	}
+}
+
+// printStatus prints a flat table of every local branch with its upstream,
+// ahead/behind counts, and last commit message. Only the current branch's
+// working tree can be checked for cleanliness.
+func printStatus(w io.Writer) error {
+	git := cliRunner{verbosityQuiet, w}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range branchMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := newColumnWriter(w, 5, 2)
+	fmt.Fprintln(tw, "BRANCH\tUPSTREAM\tAHEAD\tBEHIND\tCLEAN\tMESSAGE")
+	for _, name := range names {
+		desc := branchMap[name].Desc
+		upstream, ahead, behind := "-", "-", "-"
+		if desc.Upstream != "" {
+			upstream = desc.Upstream
+			if desc.Status == "gone" {
+				upstream += " (gone)"
+			} else {
+				ahead, behind = strconv.Itoa(desc.Ahead), strconv.Itoa(desc.Behind)
+			}
+		}
+		clean := "n/a"
+		if desc.Current {
+			changes, err := gitext.WorkingTreeChanges(git, true)
+			if err != nil {
+				return err
+			}
+			switch {
+			case len(changes.Staged) > 0 || len(changes.Unstaged) > 0:
+				clean = colorize("no", "red")
+			case len(changes.Untracked) > 0:
+				// Untracked files only block commands with --strict-clean.
+				clean = colorize("untracked", "yellow")
+			default:
+				clean = "yes"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join([]string{name, upstream, ahead, behind, clean, desc.Message}, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printBranchTreeJSON writes the tree as a JSON array of its roots, with
+// downstream branches nested under each.
+func printBranchTreeJSON(w io.Writer, rootBranches []*gitext.Branch) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(rootBranches)
+}
+
+// subtreeAt returns the roots of the part of the tree under root, which may
+// be a branch in the tree or the upstream of one or more of its roots.
+func subtreeAt(rootBranches []*gitext.Branch, branchMap map[string]*gitext.Branch, root string) []*gitext.Branch {
+	if br, exists := branchMap[root]; exists {
+		return []*gitext.Branch{br}
+	}
+	subtree := []*gitext.Branch{}
+	for _, br := range rootBranches {
+		if br.Desc.Upstream == root {
+			subtree = append(subtree, br)
+		}
+	}
+	return subtree
+}
+
+// filterByPattern returns copies of branches pruned to those whose names
+// match pattern, keeping the path down to each match so the structure stays
+// intact.
+func filterByPattern(branches []*gitext.Branch, pattern string) ([]*gitext.Branch, error) {
+	kept := []*gitext.Branch{}
+	for _, br := range branches {
+		downstream, err := filterByPattern(br.Downstream, pattern)
+		if err != nil {
+			return nil, err
+		}
+		matched, err := path.Match(pattern, br.Desc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if matched || len(downstream) > 0 {
+			filtered := *br
+			filtered.Downstream = downstream
+			kept = append(kept, &filtered)
+		}
+	}
+	return kept, nil
+}
+
+// inSync reports whether br has an upstream and is neither ahead of nor
+// behind it.
+func inSync(br *gitext.Branch) bool {
+	return br.Desc.Upstream != "" && br.Desc.Status != "gone" && br.Desc.Ahead == 0 && br.Desc.Behind == 0
+}
+
+// collapseClean returns copies of branches pruned of the ones in sync with
+// their upstream, keeping the current branch and the path down to every
+// branch that's kept.
+func collapseClean(branches []*gitext.Branch) []*gitext.Branch {
+	kept := []*gitext.Branch{}
+	for _, br := range branches {
+		downstream := collapseClean(br.Downstream)
+		if !inSync(br) || br.Desc.Current || len(downstream) > 0 {
+			collapsed := *br
+			collapsed.Downstream = downstream
+			kept = append(kept, &collapsed)
+		}
+	}
+	return kept
+}
+
+func drawBranchTree(w io.Writer, opts treeOptions) error {
+	git := cliRunner{verbosityQuiet, w}
+	buildTree := gitext.BranchTree
+	if opts.Remote {
+		buildTree = gitext.BranchTreeWithRemotes
+	}
+	rootBranches, branchMap, err := buildTree(git)
+	if err != nil {
+		return err
+	}
+	if opts.Descriptions {
+		descriptions, err := gitext.BranchDescriptions(git)
+		if err != nil {
+			return err
+		}
+		for name, br := range branchMap {
+			br.Desc.Description = descriptions[name]
+		}
+	}
+	if opts.Root != "" {
+		rootBranches = subtreeAt(rootBranches, branchMap, opts.Root)
+		if len(rootBranches) == 0 {
+			return fmt.Errorf("no branches under %s", opts.Root)
+		}
+	}
+	if opts.Pattern != "" {
+		if rootBranches, err = filterByPattern(rootBranches, opts.Pattern); err != nil {
+			return err
+		}
+	}
+	if opts.CollapseClean {
+		rootBranches = collapseClean(rootBranches)
+	}
+	if err := sortTree(rootBranches, opts.Sort); err != nil {
+		return err
+	}
+	switch opts.Format {
+	case "text":
+		printBranchTree(w, rootBranches, branchMap, opts)
+		return nil
+	case "json":
+		return printBranchTreeJSON(w, rootBranches)
+	case "template":
+		return printBranchTreeTemplate(w, rootBranches, opts.Template, 0)
+	case "porcelain":
+		return printBranchTreePorcelain(w, rootBranches, 0)
+	case "dot":
+		printBranchTreeDot(w, rootBranches, branchMap)
+		return nil
+	case "mermaid":
+		printBranchTreeMermaid(w, rootBranches, branchMap)
+		return nil
+	default:
+		return newUsageError("unknown tree format %q", opts.Format)
+	}
+}
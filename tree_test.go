@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cjfuller/git_ext/gitext"
+	"github.com/cjfuller/git_ext/testutil"
+)
+
+func TestParseBranchEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want gitext.BranchDescriptor
+	}{
+		{
+			name: "tracked",
+			line: "  feat-a 1a2b3c4 [origin/main] Add the thing",
+			want: gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Message: "Add the thing"},
+		},
+		{
+			name: "current",
+			line: "* feat-b 5d6e7f8 [feat-a] Build on the thing",
+			want: gitext.BranchDescriptor{Current: true, Name: "feat-b", Sha: "5d6e7f8", Upstream: "feat-a", Message: "Build on the thing"},
+		},
+		{
+			name: "untracked",
+			line: "  scratch 9a8b7c6 Try something [wip]",
+			want: gitext.BranchDescriptor{Name: "scratch", Sha: "9a8b7c6", Message: "Try something [wip]"},
+		},
+		{
+			name: "untracked without a message",
+			line: "  empty 9a8b7c6",
+			want: gitext.BranchDescriptor{Name: "empty", Sha: "9a8b7c6"},
+		},
+		{
+			name: "ahead",
+			line: "  feat-a 1a2b3c4 [origin/main: ahead 2] Add the thing",
+			want: gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Status: "ahead 2", Message: "Add the thing"},
+		},
+		{
+			name: "behind",
+			line: "  feat-a 1a2b3c4 [origin/main: behind 1] Add the thing",
+			want: gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Status: "behind 1", Message: "Add the thing"},
+		},
+		{
+			name: "ahead and behind",
+			line: "  feat-a 1a2b3c4 [origin/main: ahead 2, behind 1] Add the thing",
+			want: gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Status: "ahead 2, behind 1", Message: "Add the thing"},
+		},
+		{
+			name: "gone",
+			line: "  old 1a2b3c4 [origin/old: gone] Merged already",
+			want: gitext.BranchDescriptor{Name: "old", Sha: "1a2b3c4", Upstream: "origin/old", Status: "gone", Message: "Merged already"},
+		},
+		{
+			name: "detached",
+			line: "* (HEAD detached at 1a2b3c4) 1a2b3c4 Add the thing",
+			want: gitext.BranchDescriptor{Current: true, Detached: true, Name: "(HEAD detached at 1a2b3c4)", Sha: "1a2b3c4", Message: "Add the thing"},
+		},
+		{
+			name: "detached with a bracketed message",
+			line: "* (HEAD detached from origin/main) 1a2b3c4 [skip ci] Bump",
+			want: gitext.BranchDescriptor{Current: true, Detached: true, Name: "(HEAD detached from origin/main)", Sha: "1a2b3c4", Message: "[skip ci] Bump"},
+		},
+		{
+			name: "name only",
+			line: "  merged-one",
+			want: gitext.BranchDescriptor{Name: "merged-one"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseBranchEntry(test.line)
+			if err != nil {
+				t.Fatalf("parseBranchEntry(%q): %v", test.line, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseBranchEntry(%q) =\n%+v\nwant\n%+v", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseBranchEntryErrors(t *testing.T) {
+	for _, line := range []string{"", "* (HEAD detached at 1a2b3c4"} {
+		if desc, err := parseBranchEntry(line); err == nil {
+			t.Errorf("parseBranchEntry(%q) = %+v, want an error", line, desc)
+		}
+	}
+}
+
+func TestParseBranchEntryWorktree(t *testing.T) {
+	tests := []struct {
+		line string
+		want gitext.BranchDescriptor
+	}{
+		{
+			line: "+ feat-c 1a2b3c4 (/home/me/src/feat-c) [origin/main: ahead 1] Elsewhere",
+			want: gitext.BranchDescriptor{Worktree: true, WorktreePath: "/home/me/src/feat-c", Name: "feat-c", Sha: "1a2b3c4", Upstream: "origin/main", Status: "ahead 1", Message: "Elsewhere"},
+		},
+		{
+			line: "+ feat-c 1a2b3c4 (/home/me/my worktrees/feat-c) Elsewhere",
+			want: gitext.BranchDescriptor{Worktree: true, WorktreePath: "/home/me/my worktrees/feat-c", Name: "feat-c", Sha: "1a2b3c4", Message: "Elsewhere"},
+		},
+		{
+			line: "+ feat-c 1a2b3c4 (/home/me/src/feat-c)",
+			want: gitext.BranchDescriptor{Worktree: true, WorktreePath: "/home/me/src/feat-c", Name: "feat-c", Sha: "1a2b3c4"},
+		},
+		{
+			// Only worktree branches have their path listed.
+			line: "  feat-d 1a2b3c4 (not a path) Message",
+			want: gitext.BranchDescriptor{Name: "feat-d", Sha: "1a2b3c4", Message: "(not a path) Message"},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseBranchEntry(test.line)
+		if err != nil {
+			t.Errorf("parseBranchEntry(%q): %v", test.line, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseBranchEntry(%q) =\n%+v\nwant\n%+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseBranchEntryRemote(t *testing.T) {
+	tests := []struct {
+		line string
+		want gitext.BranchDescriptor
+	}{
+		{
+			line: "  remotes/origin/main 1a2b3c4 Merge the thing",
+			want: gitext.BranchDescriptor{Remote: true, Name: "origin/main", Sha: "1a2b3c4", Message: "Merge the thing"},
+		},
+		{
+			line: "  remotes/origin/HEAD -> origin/main",
+			want: gitext.BranchDescriptor{Remote: true, Name: "origin/HEAD", AliasOf: "origin/main"},
+		},
+		{
+			line: "  remotes/upstream/feat/x 5d6e7f8 Theirs",
+			want: gitext.BranchDescriptor{Remote: true, Name: "upstream/feat/x", Sha: "5d6e7f8", Message: "Theirs"},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseBranchEntry(test.line)
+		if err != nil {
+			t.Errorf("parseBranchEntry(%q): %v", test.line, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseBranchEntry(%q) =\n%+v\nwant\n%+v", test.line, got, test.want)
+		}
+	}
+}
+
+// noColor turns off colored output, returning a func that restores it.
+func noColor() func() {
+	old := colorEnabled
+	colorEnabled = false
+	return func() { colorEnabled = old }
+}
+
+// tree links descriptors into roots and a map by name, as gitext.BranchTree
+// does.
+func tree(descs ...gitext.BranchDescriptor) ([]*gitext.Branch, map[string]*gitext.Branch) {
+	branchMap := map[string]*gitext.Branch{}
+	names := []string{}
+	for _, desc := range descs {
+		branchMap[desc.Name] = &gitext.Branch{Desc: desc, Downstream: []*gitext.Branch{}}
+		names = append(names, desc.Name)
+	}
+	roots := []*gitext.Branch{}
+	for _, name := range names {
+		br := branchMap[name]
+		if upstream, ok := branchMap[br.Desc.Upstream]; ok {
+			upstream.Downstream = append(upstream.Downstream, br)
+			br.HasUpstream = true
+		} else {
+			roots = append(roots, br)
+		}
+	}
+	return roots, branchMap
+}
+
+func TestPrintBranchTreeWorktree(t *testing.T) {
+	defer noColor()()
+	roots, branchMap := tree(
+		gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Message: "Here", Current: true},
+		gitext.BranchDescriptor{Name: "feat-b", Sha: "5d6e7f8", Upstream: "feat-a", Message: "Elsewhere", Worktree: true},
+	)
+	var out bytes.Buffer
+	printBranchTree(&out, roots, branchMap, treeOptions{})
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 3 || !strings.Contains(lines[2], "feat-b (worktree)") {
+		t.Errorf("the worktree branch isn't marked:\n%s", out.String())
+	}
+	if strings.Contains(lines[1], "(worktree)") {
+		t.Errorf("the current branch is marked as in another worktree:\n%s", out.String())
+	}
+}
+
+func TestFormatTrackingStatus(t *testing.T) {
+	defer noColor()()
+	tests := []struct {
+		desc gitext.BranchDescriptor
+		want string
+	}{
+		{gitext.BranchDescriptor{}, "[ahead 0, behind 0]"},
+		{gitext.BranchDescriptor{Status: "ahead 2", Ahead: 2}, "[ahead 2, behind 0]"},
+		{gitext.BranchDescriptor{Status: "behind 1", Behind: 1}, "[ahead 0, behind 1]"},
+		{gitext.BranchDescriptor{Status: "ahead 2, behind 1", Ahead: 2, Behind: 1}, "[ahead 2, behind 1]"},
+		{gitext.BranchDescriptor{Status: "gone"}, "[gone]"},
+	}
+	for _, test := range tests {
+		if got := formatTrackingStatus(test.desc); got != test.want {
+			t.Errorf("formatTrackingStatus with status %q = %q, want %q", test.desc.Status, got, test.want)
+		}
+	}
+}
+
+func TestPrintBranchTreeTrackingStatus(t *testing.T) {
+	defer noColor()()
+	roots, branchMap := tree(
+		gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Status: "ahead 2, behind 1", Ahead: 2, Behind: 1, Message: "Add a"},
+		gitext.BranchDescriptor{Name: "merged", Sha: "5d6e7f8", Upstream: "origin/merged", Status: "gone", Message: "Merged already"},
+	)
+	var out bytes.Buffer
+	printBranchTree(&out, roots, branchMap, treeOptions{})
+	want := []string{
+		"+-- origin/main",
+		"  +-- feat-a                1a2b3c4 Add a          [ahead 2, behind 1]",
+		"+-- origin/merged [missing]",
+		"  +-- merged                5d6e7f8 Merged already [gone]",
+	}
+	got := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	for i := range got {
+		got[i] = strings.TrimRight(got[i], " ")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("printBranchTree printed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPrintBranchTreeSharedUpstream(t *testing.T) {
+	defer noColor()()
+	roots, branchMap := tree(
+		gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Message: "Add a"},
+		gitext.BranchDescriptor{Name: "feat-b", Sha: "5d6e7f8", Upstream: "origin/main", Message: "Add b"},
+		gitext.BranchDescriptor{Name: "feat-c", Sha: "9a8b7c6", Upstream: "feat-b", Message: "Add c"},
+		gitext.BranchDescriptor{Name: "hotfix", Sha: "0f1e2d3", Upstream: "origin/release", Message: "Fix it"},
+	)
+	groups := groupRoots(roots, branchMap)
+	if len(groups) != 2 || groups[0].Upstream != "origin/main" || len(groups[0].Roots) != 2 {
+		t.Fatalf("roots are grouped as %+v, want feat-a and feat-b under one origin/main", groups)
+	}
+	var out bytes.Buffer
+	printBranchTree(&out, roots, branchMap, treeOptions{})
+	names := []string{}
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		names = append(names, strings.Fields(line)[1])
+	}
+	want := []string{"origin/main", "feat-a", "feat-b", "feat-c", "origin/release", "hotfix"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("printBranchTree printed %v, want %v:\n%s", names, want, out.String())
+	}
+}
+
+func TestPrintBranchTreeSubtree(t *testing.T) {
+	defer noColor()()
+	roots, branchMap := tree(
+		gitext.BranchDescriptor{Name: "feat-a", Sha: "1a2b3c4", Upstream: "origin/main", Message: "Add a"},
+		gitext.BranchDescriptor{Name: "feat-b", Sha: "5d6e7f8", Upstream: "feat-a", Message: "Add b"},
+	)
+	var out bytes.Buffer
+	printBranchTree(&out, subtreeAt(roots, branchMap, "feat-b"), branchMap, treeOptions{})
+	if got := strings.TrimRight(out.String(), " \n"); got != "  +-- feat-b 5d6e7f8 Add b [ahead 0, behind 0]" {
+		t.Errorf("the subtree at feat-b printed\n%s", out.String())
+	}
+	out.Reset()
+	printBranchTreeDot(&out, subtreeAt(roots, branchMap, "feat-b"), branchMap)
+	if strings.Contains(out.String(), "->") {
+		t.Errorf("the subtree at feat-b has an edge from its upstream:\n%s", out.String())
+	}
+}
+
+// manyBranches makes a repository with n branches, each one commit ahead of
+// main and tracking it.
+func manyBranches(b *testing.B, n int) *testutil.Repo {
+	repo := testutil.NewRepo(b)
+	for i := 0; i < n; i++ {
+		repo.Branch(fmt.Sprintf("feat-%03d", i), "main")
+		repo.Commit(fmt.Sprintf("feat %d", i))
+	}
+	repo.Checkout("main")
+	return repo
+}
+
+// BenchmarkBranchTree times building the tree with the single for-each-ref
+// BranchTree runs.
+func BenchmarkBranchTree(b *testing.B) {
+	repo := manyBranches(b, 100)
+	defer repo.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := gitext.BranchTree(repo); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBranchTreePerBranch times the approach BranchTree replaced, for
+// comparison: parsing git branch -vv, then counting ahead and behind with a
+// git call per branch.
+func BenchmarkBranchTreePerBranch(b *testing.B) {
+	repo := manyBranches(b, 100)
+	defer repo.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range strings.Split(repo.Git("branch", "-vv"), "\n") {
+			desc, err := parseBranchEntry(line)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if desc.Upstream == "" {
+				continue
+			}
+			if _, _, err := gitext.AheadBehind(repo, desc.Name, desc.Upstream); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// wideRanges are the code points terminals draw two cells wide: East Asian
+// wide and fullwidth characters, and emoji.
+var wideRanges = []struct{ lo, hi rune }{
+	{0x1100, 0x115F},   // Hangul Jamo initial consonants
+	{0x231A, 0x231B},   // watch, hourglass
+	{0x23E9, 0x23EC},   // media controls
+	{0x23F0, 0x23F3},   // alarm clock, timers
+	{0x25FD, 0x25FE},   // small squares
+	{0x2614, 0x2615},   // umbrella, hot beverage
+	{0x2648, 0x2653},   // zodiac
+	{0x26A1, 0x26A1},   // high voltage
+	{0x26AA, 0x26AB},   // circles
+	{0x26BD, 0x26BE},   // soccer ball, baseball
+	{0x26C4, 0x26C5},   // snowman, sun behind cloud
+	{0x26D4, 0x26D4},   // no entry
+	{0x26EA, 0x26EA},   // church
+	{0x26F2, 0x26F5},   // fountain ... sailboat
+	{0x26FA, 0x26FD},   // tent ... fuel pump
+	{0x2705, 0x2705},   // check mark button
+	{0x270A, 0x270B},   // raised fists
+	{0x2728, 0x2728},   // sparkles
+	{0x274C, 0x274C},   // cross mark
+	{0x2753, 0x2757},   // question and exclamation marks
+	{0x2795, 0x2797},   // plus, minus, divide
+	{0x27B0, 0x27BF},   // curly loops
+	{0x2B1B, 0x2B1C},   // large squares
+	{0x2B50, 0x2B55},   // star, circle
+	{0x2E80, 0x303E},   // CJK radicals, punctuation
+	{0x3041, 0x33FF},   // kana, CJK compatibility
+	{0x3400, 0x4DBF},   // CJK extension A
+	{0x4E00, 0x9FFF},   // CJK unified ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xA960, 0xA97F},   // Hangul Jamo extended A
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE10, 0xFE19},   // vertical forms
+	{0xFE30, 0xFE6F},   // CJK compatibility forms, small forms
+	{0xFF00, 0xFF60},   // fullwidth forms
+	{0xFFE0, 0xFFE6},   // fullwidth signs
+	{0x1F004, 0x1F004}, // mahjong tile
+	{0x1F0CF, 0x1F0CF}, // playing card
+	{0x1F18E, 0x1F18E}, // AB button
+	{0x1F191, 0x1F19A}, // squared words
+	{0x1F200, 0x1F2FF}, // enclosed ideographic supplement
+	{0x1F300, 0x1F64F}, // pictographs, emoticons
+	{0x1F680, 0x1F6FF}, // transport and map symbols
+	{0x1F7E0, 0x1F7EB}, // colored circles and squares
+	{0x1F90C, 0x1F9FF}, // supplemental symbols and pictographs
+	{0x1FA70, 0x1FAFF}, // symbols and pictographs extended A
+	{0x20000, 0x3FFFD}, // CJK extensions B onward
+}
+
+// runeWidth is how many terminal cells r takes up.
+func runeWidth(r rune) int {
+	if r == 0x200D || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) || unicode.Is(unicode.Cf, r) || (r >= 0xFE00 && r <= 0xFE0F) {
+		// Zero width joiners, combining marks, and variation selectors
+		// modify the character before them.
+		return 0
+	}
+	for _, wide := range wideRanges {
+		if r < wide.lo {
+			break
+		}
+		if r <= wide.hi {
+			return 2
+		}
+	}
+	return 1
+}
+
+// displayWidth is how many terminal cells s takes up, not counting ANSI
+// color codes.
+func displayWidth(s string) int {
+	width := 0
+	inEscape := false
+	for _, r := range s {
+		switch {
+		case inEscape:
+			inEscape = !(r >= '@' && r <= '~' && r != '[')
+		case r == '\x1b':
+			inEscape = true
+		default:
+			width += runeWidth(r)
+		}
+	}
+	return width
+}
+
+// columnWriter aligns tab-separated columns like text/tabwriter, but by
+// display width rather than rune count, so that CJK characters and emoji
+// line up. Every cell ending in a tab is padded to the widest in its column,
+// across all lines; the text after a line's last tab isn't. Nothing is
+// written until Flush.
+type columnWriter struct {
+	w        io.Writer
+	minWidth int
+	padding  int
+	buf      bytes.Buffer
+}
+
+func newColumnWriter(w io.Writer, minWidth int, padding int) *columnWriter {
+	return &columnWriter{w: w, minWidth: minWidth, padding: padding}
+}
+
+func (c *columnWriter) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+// Flush writes everything written so far, aligned.
+func (c *columnWriter) Flush() error {
+	text := c.buf.String()
+	c.buf.Reset()
+	lines := strings.Split(text, "\n")
+	rows := make([][]string, len(lines))
+	widths := []int{}
+	for i, line := range lines {
+		rows[i] = strings.Split(line, "\t")
+		for col, cell := range rows[i][:len(rows[i])-1] {
+			width := displayWidth(cell) + c.padding
+			if width < c.minWidth {
+				width = c.minWidth
+			}
+			if col == len(widths) {
+				widths = append(widths, width)
+			} else if width > widths[col] {
+				widths[col] = width
+			}
+		}
+	}
+	out := strings.Builder{}
+	for i, cells := range rows {
+		last := len(cells) - 1
+		for col, cell := range cells[:last] {
+			out.WriteString(cell)
+			out.WriteString(strings.Repeat(" ", widths[col]-displayWidth(cell)))
+		}
+		out.WriteString(cells[last])
+		if i < len(rows)-1 {
+			out.WriteString("\n")
+		}
+	}
+	_, err := io.WriteString(c.w, out.String())
+	return err
+}
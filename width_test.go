@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"feat-a", 6},
+		{"caf\u00e9", 4},
+		{"cafe\u0301", 4},
+		{"機能", 4},
+		{"修正-バグ", 9},
+		{"한글", 4},
+		{"ｆｕｌｌ", 8},
+		{"🚀", 2},
+		{"fix-🐛", 6},
+		{"👍🏽", 4},
+		{"👩‍💻", 4},
+		{"\x1b[32mfeat-a\x1b[0m", 6},
+	}
+	for _, test := range tests {
+		if got := displayWidth(test.s); got != test.want {
+			t.Errorf("displayWidth(%q) = %d, want %d", test.s, got, test.want)
+		}
+	}
+}
+
+func TestColumnWriterAlignsWideText(t *testing.T) {
+	var out bytes.Buffer
+	cw := newColumnWriter(&out, 0, 1)
+	for _, line := range []string{
+		"feat-a\t1a2b3c4\tplain",
+		"機能\t5d6e7f8\tCJK",
+		"fix-🐛\t9a8b7c6\temoji",
+	} {
+		cw.Write([]byte(line + "\n"))
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for _, line := range lines {
+		// The sha column starts at the same cell on every line.
+		name := line[:strings.IndexAny(line, "159")]
+		if displayWidth(name) != displayWidth("feat-a ") {
+			t.Errorf("%q: the sha starts at cell %d, want %d", line, displayWidth(name), displayWidth("feat-a "))
+		}
+	}
+}
+
+func TestParseBranchEntryUnicode(t *testing.T) {
+	tests := []struct {
+		line string
+		want gitext.BranchDescriptor
+	}{
+		{
+			line: "* 機能/検索 1a2b3c4 [origin/main: ahead 1] 検索を追加",
+			want: gitext.BranchDescriptor{Current: true, Name: "機能/検索", Sha: "1a2b3c4", Upstream: "origin/main", Status: "ahead 1", Message: "検索を追加"},
+		},
+		{
+			line: "  fix-🐛 5d6e7f8 [機能/検索] Squash the 🐛 for good",
+			want: gitext.BranchDescriptor{Name: "fix-🐛", Sha: "5d6e7f8", Upstream: "機能/検索", Message: "Squash the 🐛 for good"},
+		},
+		{
+			// A no-break space is part of the name, not a separator.
+			line: "  a\u00a0b 9a8b7c6 Odd name",
+			want: gitext.BranchDescriptor{Name: "a\u00a0b", Sha: "9a8b7c6", Message: "Odd name"},
+		},
+		{
+			line: "  ideo 9a8b7c6 Message with an\u3000ideographic space",
+			want: gitext.BranchDescriptor{Name: "ideo", Sha: "9a8b7c6", Message: "Message with an\u3000ideographic space"},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseBranchEntry(test.line)
+		if err != nil {
+			t.Errorf("parseBranchEntry(%q): %v", test.line, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseBranchEntry(%q) =\n%+v\nwant\n%+v", test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cjfuller/git_ext/gitext"
+)
+
+// Workspaces are kept in the repository's git config as
+// gitext.workspace.<name>.head, the branch to return to, and one
+// gitext.workspace.<name>.branch for each branch in its stack.
+const workspaceConfigPrefix = "gitext.workspace."
+
+// workspace is a named branch and the stack under it.
+type workspace struct {
+	Name     string
+	Head     string
+	Branches []string
+}
+
+// readWorkspaces loads every saved workspace, sorted by name.
+func readWorkspaces(git gitext.Runner) ([]workspace, error) {
+	output, err := git.Run([]string{"config", "--local", "--null", "--get-regexp", `^gitext\.workspace\.`})
+	if gitErr, ok := err.(*gitext.GitError); ok && gitErr.ExitCode == 1 {
+		// None are saved.
+		return []workspace{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	byName := map[string]*workspace{}
+	for _, entry := range strings.Split(output, "\x00") {
+		newline := strings.Index(entry, "\n")
+		if newline < 0 {
+			continue
+		}
+		key, value := strings.TrimPrefix(entry[:newline], workspaceConfigPrefix), entry[newline+1:]
+		dot := strings.LastIndex(key, ".")
+		if dot < 0 {
+			continue
+		}
+		name := key[:dot]
+		ws, ok := byName[name]
+		if !ok {
+			ws = &workspace{Name: name, Branches: []string{}}
+			byName[name] = ws
+		}
+		switch key[dot+1:] {
+		case "head":
+			ws.Head = value
+		case "branch":
+			ws.Branches = append(ws.Branches, value)
+		}
+	}
+	workspaces := []workspace{}
+	for _, ws := range byName {
+		workspaces = append(workspaces, *ws)
+	}
+	sort.Slice(workspaces, func(i, j int) bool { return workspaces[i].Name < workspaces[j].Name })
+	return workspaces, nil
+}
+
+// saveWorkspace records the current branch and the local branches under it
+// as the workspace name, replacing any workspace already saved as name.
+func saveWorkspace(w io.Writer, name string, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	if strings.ContainsAny(name, ".\n") || name == "" {
+		return newUsageError("workspace names can't be empty or contain dots, got %q", name)
+	}
+	branch, err := gitext.RequireBranch(git)
+	if err != nil {
+		return err
+	}
+	_, branchMap, err := gitext.BranchTree(git)
+	if err != nil {
+		return err
+	}
+	chain, err := gitext.ChainToRoot(branchMap, branch)
+	if err != nil {
+		return err
+	}
+	section := workspaceConfigPrefix + name
+	if _, err := rungit(w, []string{"config", "--local", "--remove-section", section}, verbosityQuiet); err != nil {
+		if gitErr, ok := err.(*gitext.GitError); !ok || !strings.Contains(gitErr.Stderr, "no such section") {
+			return err
+		}
+	}
+	if _, err := rungit(w, []string{"config", "--local", section + ".head", branch}, verbose); err != nil {
+		return err
+	}
+	for _, name := range chain {
+		if _, ok := branchMap[name]; !ok {
+			continue
+		}
+		if _, err := rungit(w, []string{"config", "--local", "--add", section + ".branch", name}, verbose); err != nil {
+			return err
+		}
+	}
+	if verbose != verbosityQuiet {
+		fmt.Fprintf(w, "saved workspace %s at %s\n", name, branch)
+	}
+	return nil
+}
+
+// checkoutWorkspace checks out the branch workspace name was saved at,
+// warning about any of its branches that have since been deleted.
+func checkoutWorkspace(w io.Writer, name string, verbose verbosity) error {
+	git := cliRunner{verbose, w}
+	workspaces, err := readWorkspaces(git)
+	if err != nil {
+		return err
+	}
+	for _, ws := range workspaces {
+		if ws.Name != name {
+			continue
+		}
+		for _, branch := range ws.Branches {
+			if exists, err := gitext.RefExists(git, "refs/heads/"+branch); err != nil {
+				return err
+			} else if !exists {
+				fmt.Fprintln(w, colorize("workspace "+name+"'s branch "+branch+" no longer exists", "yellow"))
+			}
+		}
+		return gitext.Checkout(git, ws.Head, submodules)
+	}
+	return fmt.Errorf("no workspace named %s", name)
+}
+
+// printWorkspaces lists each saved workspace with its stack, bottom first.
+func printWorkspaces(w io.Writer) error {
+	workspaces, err := readWorkspaces(cliRunner{verbosityQuiet, w})
+	if err != nil {
+		return err
+	}
+	for _, ws := range workspaces {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", ws.Name, ws.Head, strings.Join(ws.Branches, " -> ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}